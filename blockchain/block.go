@@ -2,9 +2,12 @@ package blockchain
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
-	"encoding/gob"
-	"log"
+	"errors"
+	"time"
+
+	"github.com/tezansahu/golang_blockchain/merkle"
 )
 
 // Structure of a block in the blockchain
@@ -12,67 +15,91 @@ type Block struct {
 	Hash         []byte
 	Transactions []*Transaction
 	PrevHash     []byte
+	MerkleRoot   []byte // Root of the Merkle Tree of the transactions, committed to by the PoW
 	Nonce        int
+	Height       int    // Number of blocks preceding this block in the chain
+	Timestamp    int64  // Unix time at which the block was created
+	Difficulty   int    // Number of leading zero bits required in the hash of the block
+	Extra        []byte // Data of the consensus engine, committed to by the seal
+	Signature    []byte // Signature of the block by its sealer, for engines sealing by signing
+	Version      int    // Version of the block, deciding how it is hashed (see BlockVersion)
+}
+
+// Build a Merkle Tree from the IDs of the transactions in a block
+func (b *Block) MerkleTree() *merkle.Tree {
+	return merkle.NewTree(b.txIDs())
 }
 
-// Create the hash of all transactions in a block
+// Create the hash of all transactions in a block (the root of their Merkle
+// Tree, or the hash of their concatenated IDs for legacy blocks)
 func (b *Block) HashTransactions() []byte {
-	var txHashes [][]byte
-	var txHash [32]byte
+	if b.Version == LegacyBlockVersion {
+		hash := sha256.Sum256(bytes.Join(b.txIDs(), []byte{}))
+		return hash[:]
+	}
+
+	return b.MerkleTree().RootHash()
+}
+
+// Get the IDs of the transactions in a block
+func (b *Block) txIDs() [][]byte {
+	var txIDs [][]byte
 
 	for _, tx := range b.Transactions {
-		txHashes = append(txHashes, tx.ID)
+		txIDs = append(txIDs, tx.ID)
 	}
 
-	txHash = sha256.Sum256(bytes.Join(txHashes, []byte{}))
+	return txIDs
+}
 
-	return txHash[:]
+// Produce a proof that the transaction with the given ID is included in the block
+func (b *Block) MerkleProof(txID []byte) (*merkle.Proof, error) {
+	if b.Version == LegacyBlockVersion {
+		return nil, errors.New("Legacy blocks do not commit to a Merkle Tree")
+	}
+
+	return b.MerkleTree().Proof(txID)
 }
 
-// Given the transactions and previous block hash, create a block using PoW
-func CreateBlock(txs []*Transaction, prevHash []byte) *Block {
-	block := &Block{[]byte{}, txs, prevHash, 0}
-	pow := NewProof(block)
-	nonce, hash := pow.Run()
+// Given the transactions, previous block hash, height and difficulty, create a
+// block that is not sealed yet (without a Hash)
+func NewBlock(txs []*Transaction, prevHash []byte, height, difficulty int) *Block {
+	block := &Block{[]byte{}, txs, prevHash, nil, 0, height, time.Now().Unix(), difficulty, nil, nil, BlockVersion}
+	block.MerkleRoot = block.HashTransactions()
 
-	block.Hash = hash[:]
-	block.Nonce = nonce
 	return block
 }
 
-// Create the Genesis Block of the blockchain
-func Genesis(coinbase *Transaction) *Block {
-	return CreateBlock([]*Transaction{coinbase}, []byte{})
+// Given the transactions, previous block hash, height and difficulty, create a block using PoW
+func CreateBlock(txs []*Transaction, prevHash []byte, height, difficulty int) (*Block, error) {
+	return CreateBlockContext(context.Background(), txs, prevHash, height, difficulty)
 }
 
-// Function to serialize the block structure into bytes (to be used while hashing a block)
-func (b *Block) Serialize() []byte {
-	var res bytes.Buffer
-	encoder := gob.NewEncoder(&res)
-
-	err := encoder.Encode(b)
+// Create a block like CreateBlock, giving up with the error of the context if it is cancelled while mining
+func CreateBlockContext(ctx context.Context, txs []*Transaction, prevHash []byte, height, difficulty int) (*Block, error) {
+	block := NewBlock(txs, prevHash, height, difficulty)
 
-	Handle(err)
+	if err := NewPoW().Seal(ctx, nil, block); err != nil {
+		return nil, err
+	}
 
-	return res.Bytes()
+	return block, nil
 }
 
-// Function to deserialize (recover the block structure) from bytes
-func Deserialize(data []byte) *Block {
-	var block Block
-	decoder := gob.NewDecoder(bytes.NewReader(data))
-
-	err := decoder.Decode(&block)
-
-	Handle(err)
+// Create the Genesis Block of the blockchain
+func Genesis(coinbase *Transaction) (*Block, error) {
+	return CreateBlock([]*Transaction{coinbase}, []byte{}, 0, InitialDifficulty)
+}
 
-	return &block
+// Function to serialize the block structure into bytes, using the canonical encoding
+func (b *Block) Serialize() []byte {
+	var e encoder
+	encodeBlock(&e, b)
 
+	return e.buf.Bytes()
 }
 
-// Log errors onto the console
-func Handle(err error) {
-	if err != nil {
-		log.Panic(err)
-	}
+// Function to deserialize (recover the block structure) from bytes
+func Deserialize(data []byte) (*Block, error) {
+	return decodeBlock(data)
 }
@@ -2,191 +2,487 @@ package blockchain
 
 import (
 	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"encoding/hex"
 	"errors"
-	"fmt"
+	"math/big"
 	"os"
-	"runtime"
+	"path/filepath"
+	"sync"
 
 	"github.com/dgraph-io/badger"
 )
 
-// Define paths where blockchain data will be stored
+// Define paths where blockchain data will be stored, within the data directory of a network
 const (
-	dbPath      = "./tmp/blocks"
-	dbFile      = "./tmp/blocks/MANIFEST"
-	genesisData = "First Transaction from Genesis"
+	dbPath = "blocks"
+	dbFile = "blocks/MANIFEST"
 )
 
-// Structure of the blockchain
+// Default data directory, holding one subdirectory per network
+const DefaultDataDir = "./tmp"
+
+// Structure of the blockchain. It can be used by several goroutines at once:
+// the last block is only ever moved by a database transaction checking that it
+// is still the block the new one builds on, and queries each read a consistent
+// snapshot of the database.
 type Blockchain struct {
-	LastHash []byte
 	Database *badger.DB
+	Engine   Consensus   // Consensus engine sealing and verifying the blocks of the chain
+	Params   ChainParams // Parameters the chain was created with
+	Dir      string      // Data directory of the network, holding the blocks and the wallets
+
+	mu       sync.RWMutex // Guards lastHash, and orders the writers moving the last block
+	lastHash []byte       // Hash of the last block of the chain
 }
 
+// Key under which the hash of the last block of the chain is stored in the database
+var lastHashKey = []byte("lh")
+
 // Iterator to iterate through the blockchain
 type BlockchainIterator struct {
 	CurrentHash []byte
 	Database    *badger.DB // This database stores blockdata and metadata as key-value pairs
 }
 
-// Check if the Database containing information about the blockchain exists
-func DBexists() bool {
-	if _, err := os.Stat(dbFile); os.IsNotExist(err) {
+// Check if the Database containing information about the blockchain of a network exists in the data directory
+func DBexists(dataDir string, network Network) bool {
+	if _, err := os.Stat(filepath.Join(network.DataDir(dataDir), dbFile)); os.IsNotExist(err) {
 		return false
 	}
 
 	return true
 }
 
-// Initialize a blockchain
-func InitBlockchain(address string) *Blockchain {
-	var lastHash []byte
-
-	if DBexists() {
-		fmt.Println("Blockchain already exists!")
-		runtime.Goexit()
-	}
+// Open the database of the blockchain of a network in the data directory
+func openDB(dataDir string, network Network) (*badger.DB, error) {
+	path := filepath.Join(network.DataDir(dataDir), dbPath)
 
 	// Set required options for the Badger Database
 	opts := badger.DefaultOptions
-	opts.Dir = dbPath
-	opts.ValueDir = dbPath
+	opts.Dir = path
+	opts.ValueDir = path
 
-	db, err := badger.Open(opts)
-	Handle(err)
+	return badger.Open(opts)
+}
 
-	// Update the database with a Coinbase Txn
-	err = db.Update(func(txn *badger.Txn) error {
+// Errors returned when a blockchain, or data within it, cannot be found or used
+var (
+	ErrChainNotFound    = errors.New("blockchain does not exist")
+	ErrChainExists      = errors.New("blockchain already exists")
+	ErrOutdatedDatabase = errors.New("blockchain uses an older database format")
+	ErrBlockNotFound    = errors.New("block does not exist")
+	ErrTxNotFound       = errors.New("transaction does not exist")
+)
 
-		cbtx := CoinbaseTx(address, genesisData)
-		genesis := Genesis(cbtx)
-		fmt.Println("Genesis Created")
+// Initialize the blockchain of a network in the data directory with the chain
+// parameters of the network, whose blocks are sealed by the given consensus
+// engine (configured for those parameters). The parameters are recorded in the
+// genesis file of the network, and their hash in the database.
+func InitBlockchain(dataDir string, network Network, address string, engine Consensus) (*Blockchain, error) {
+	params := network.Params
 
-		// create a new pair with key as hash of genesis block,
-		// and value as the serialized data of the genesis block
-		err := txn.Set(genesis.Hash, genesis.Serialize())
-		Handle(err)
+	if DBexists(dataDir, network) {
+		return nil, ErrChainExists
+	}
+	if legacyDBExists(dataDir, network) {
+		return nil, legacyDBError(dataDir)
+	}
 
-		// create a new pair with key a "lh" (last hash) and
-		// value as the hash of genesis block
-		err = txn.Set([]byte("lh"), genesis.Hash)
+	if err := params.Validate(); err != nil {
+		return nil, err
+	}
 
-		lastHash = genesis.Hash
-		return err
+	// Mine the genesis block before creating the database, so that an
+	// interrupted mining does not leave an empty database behind
+	cbtx, err := GenesisTx(address, params)
+	if err != nil {
+		return nil, err
+	}
+	difficulty, err := engine.Difficulty(nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	genesis := NewBlock([]*Transaction{cbtx}, []byte{}, 0, difficulty)
+	if err := engine.Seal(context.Background(), nil, genesis); err != nil {
+		return nil, err
+	}
+
+	db, err := openDB(dataDir, network)
+	if err != nil {
+		return nil, err
+	}
+
+	err = params.Save(filepath.Join(network.DataDir(dataDir), genesisFile))
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// Update the database with a Coinbase Txn
+	err = db.Update(func(txn *badger.Txn) error {
+		// Record the consensus engine used by the chain
+		if err := txn.Set([]byte("consensus"), []byte(engine.Name())); err != nil {
+			return err
+		}
+		if err := setDBVersion(txn, DBVersion); err != nil {
+			return err
+		}
+		if err := txn.Set(paramsKey, params.Hash()); err != nil {
+			return err
+		}
+
+		// Store the genesis block, update the UTXO set and indexes with it
+		// and make it the last block of the chain
+		if err := storeBlock(txn, genesis, engine.Work(genesis)); err != nil {
+			return err
+		}
+		return connectBlock(txn, genesis)
 	})
 
-	Handle(err)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
 
-	blockchain := Blockchain{lastHash, db}
-	return &blockchain
+	blockchain := &Blockchain{Database: db, Engine: engine, Params: params, Dir: network.DataDir(dataDir), lastHash: genesis.Hash}
+	return blockchain, nil
 }
 
-// Continue the already existing blockchain
-func ContinueBlockchain(address string) *Blockchain {
-	var lastHash []byte
+// Continue the already existing blockchain of a network in the data directory,
+// using the consensus engine and the chain parameters it was created with
+func ContinueBlockchain(dataDir string, network Network, address string) (*Blockchain, error) {
+	var lastHash, paramsHash []byte
+	var version int
+	engineName := "pow"
 
-	if DBexists() == false {
-		fmt.Println("Blockchain does not exist; Create one!")
-		runtime.Goexit()
+	if DBexists(dataDir, network) == false {
+		if legacyDBExists(dataDir, network) {
+			return nil, legacyDBError(dataDir)
+		}
+		return nil, ErrChainNotFound
 	}
 
-	// Set required options for the Badger Database
-	opts := badger.DefaultOptions
-	opts.Dir = dbPath
-	opts.ValueDir = dbPath
+	params, err := NetworkParams(dataDir, network)
+	if err != nil {
+		return nil, err
+	}
 
-	db, err := badger.Open(opts)
-	Handle(err)
+	db, err := openDB(dataDir, network)
+	if err != nil {
+		return nil, err
+	}
 
 	// Get the details about the latest block in the blockchain from the database
-	err = db.Update(func(txn *badger.Txn) error {
+	err = db.View(func(txn *badger.Txn) error {
 		// Use the "lh" (last hash) key to obtain required data
-		item, err := txn.Get([]byte("lh"))
-		Handle(err)
-		lastHash, err = item.Value()
+		var err error
+		lastHash, err = getLastHash(txn)
+		if err != nil {
+			return err
+		}
+
+		version, err = getDBVersion(txn)
+		if err != nil {
+			return err
+		}
+
+		// Chains created before their parameters were recorded are not checked
+		item, err := txn.Get(paramsKey)
+		if err == nil {
+			paramsHash, err = item.ValueCopy(nil)
+		}
+		if err != nil && err != badger.ErrKeyNotFound {
+			return err
+		}
+
+		// Chains created before engines were recorded all use PoW
+		item, err = txn.Get([]byte("consensus"))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		name, err := item.Value()
+		engineName = string(name)
 		return err
 	})
 
-	Handle(err)
+	switch {
+	case err != nil:
+	case version < DBVersion:
+		err = ErrOutdatedDatabase
+	case paramsHash != nil && !bytes.Equal(paramsHash, params.Hash()):
+		err = ErrParamsMismatch
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
 
 	// Set the current state of the blockchain using data obtained from the database
-	blockchain := Blockchain{lastHash, db}
-	return &blockchain
+	blockchain := &Blockchain{Database: db, Params: params, Dir: network.DataDir(dataDir), lastHash: lastHash}
+
+	blockchain.Engine, err = NewConsensus(engineName, blockchain)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return blockchain, nil
+}
+
+// Mine a block with the given transactions on top of the last block and add it to the blockchain
+func (chain *Blockchain) AddBlock(transactions []*Transaction) (*Block, error) {
+	return chain.AddBlockContext(context.Background(), transactions)
+}
+
+// Add a block like AddBlock, giving up with the error of the context if it is
+// cancelled while mining. Nothing is written to the database in that case. If
+// another block is added while this one is mined, the block is built and mined
+// again on top of it.
+func (chain *Blockchain) AddBlockContext(ctx context.Context, transactions []*Transaction) (*Block, error) {
+	for {
+		newBlock, err := chain.NewBlockTemplate(transactions)
+		if err != nil {
+			return nil, err
+		}
 
+		err = chain.MineBlock(ctx, newBlock)
+		if errors.Is(err, ErrPrevHashMismatch) {
+			continue
+		}
+
+		return newBlock, err
+	}
 }
 
-// Add a block with the given transactions to the blockchain
-func (chain *Blockchain) AddBlock(transactions []*Transaction) {
+// Validate a block, either mined locally or supplied from elsewhere, and add
+// it to the blockchain. A block building on the last block extends the chain,
+// while a block building on any other known block is stored on a side chain.
+// Whenever a side chain gets more cumulative work than the main chain, the
+// chain is reorganized onto it.
+func (chain *Blockchain) AcceptBlock(block *Block) error {
+	return chain.addBlock(block, false)
+}
+
+// Add a block like AcceptBlock within a single database transaction. When
+// extendOnly is set, the block is rejected with ErrPrevHashMismatch unless it
+// builds on the last block.
+func (chain *Blockchain) addBlock(block *Block, extendOnly bool) error {
+	chain.mu.Lock()
+	defer chain.mu.Unlock()
+
 	var lastHash []byte
 
-	// Obtain the last block hash from the database
-	err := chain.Database.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte("lh"))
-		Handle(err)
-		lastHash, err = item.Value()
+	err := chain.update(func(txn *badger.Txn) error {
+		lastBlock, err := getLastBlock(txn)
+		if err != nil {
+			return err
+		}
+
+		if extendOnly || bytes.Equal(block.PrevHash, lastBlock.Hash) {
+			if err := chain.validateBlock(txn, block); err != nil {
+				return err
+			}
+			work, err := chain.chainWork(txn, lastBlock)
+			if err != nil {
+				return err
+			}
+			if err := storeBlock(txn, block, work.Add(work, chain.Engine.Work(block))); err != nil {
+				return err
+			}
+
+			lastHash = block.Hash
+			return connectBlock(txn, block)
+		}
+
+		lastHash, err = chain.acceptSideBlock(txn, lastBlock, block)
 		return err
 	})
 
-	Handle(err)
+	if err != nil {
+		return err
+	}
+
+	chain.lastHash = lastHash
+
+	return nil
+}
+
+// Run fn within a read-write database transaction, running it again as long as
+// the transaction conflicts with another one committed in the meantime
+func (chain *Blockchain) update(fn func(txn *badger.Txn) error) error {
+	for {
+		err := chain.Database.Update(fn)
+		if err != badger.ErrConflict {
+			return err
+		}
+	}
+}
+
+// Get the hash of the last block of the chain
+func (chain *Blockchain) LastHash() []byte {
+	chain.mu.RLock()
+	defer chain.mu.RUnlock()
 
-	newBlock := CreateBlock(transactions, lastHash)
+	return chain.lastHash
+}
 
-	// Add the data of the newly created block to the database
-	err = chain.Database.Update(func(txn *badger.Txn) error {
-		err := txn.Set(newBlock.Hash, newBlock.Serialize())
-		Handle(err)
-		err = txn.Set([]byte("lh"), newBlock.Hash)
+// Store a block within a database transaction, along with the cumulative work
+// of the chain ending with it
+func storeBlock(txn *badger.Txn, block *Block, work *big.Int) error {
+	// create a new pair with key as hash of the block,
+	// and value as the serialized data of the block
+	if err := txn.Set(block.Hash, block.Serialize()); err != nil {
+		return err
+	}
 
-		chain.LastHash = newBlock.Hash
+	return txn.Set(workKey(block.Hash), work.Bytes())
+}
 
+// Update the UTXO set and indexes with the transactions of a stored block,
+// remove them from the mempool and make the block the last block of the chain
+func connectBlock(txn *badger.Txn, block *Block) error {
+	if err := updateUTXO(txn, block); err != nil {
 		return err
-	})
+	}
+	if err := indexTransactions(txn, block); err != nil {
+		return err
+	}
+	if err := indexHeight(txn, block); err != nil {
+		return err
+	}
+	if err := removeMined(txn, block); err != nil {
+		return err
+	}
+
+	// Make the block the last block, as long as its parent still is
+	return swapLastHash(txn, block.PrevHash, block.Hash)
+}
+
+// Replace the hash of the last block of the chain within a database
+// transaction, if it is still the expected one (the empty hash for a chain
+// without blocks) and fail with ErrPrevHashMismatch otherwise. Since badger
+// aborts a transaction that read a key written by another transaction
+// committed in the meantime, two transactions can never move the last block
+// from the same hash: the swap is atomic.
+func swapLastHash(txn *badger.Txn, expected, hash []byte) error {
+	lastHash, err := getLastHash(txn)
+	if err == badger.ErrKeyNotFound {
+		lastHash = nil
+	} else if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(lastHash, expected) {
+		return ErrPrevHashMismatch
+	}
 
-	Handle(err)
+	return txn.Set(lastHashKey, hash)
 }
 
-// Create an iterator for a blockchain
+// Get the hash of the last block of the chain within a database transaction
+func getLastHash(txn *badger.Txn) ([]byte, error) {
+	item, err := txn.Get(lastHashKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return item.ValueCopy(nil)
+}
+
+// Get the last block of the chain within a database transaction
+func getLastBlock(txn *badger.Txn) (*Block, error) {
+	lastHash, err := getLastHash(txn)
+	if err != nil {
+		return nil, err
+	}
+
+	return getBlock(txn, lastHash)
+}
+
+// Create an iterator for a blockchain, starting from its last block at the
+// time. Blocks are never modified once stored, so each goroutine can walk the
+// chain with an iterator of its own while blocks are being added.
 func (chain *Blockchain) Iterator() *BlockchainIterator {
-	iter := &BlockchainIterator{chain.LastHash, chain.Database}
+	iter := &BlockchainIterator{chain.LastHash(), chain.Database}
 
 	return iter
 }
 
 // Use the iterator to get data about the next block (actually, previous block in the chain)
-func (iter *BlockchainIterator) Next() *Block {
+func (iter *BlockchainIterator) Next() (*Block, error) {
 	var block *Block
 
 	err := iter.Database.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(iter.CurrentHash)
-		Handle(err)
-		encodedBlock, err := item.Value()
+		var err error
+		block, err = getBlock(txn, iter.CurrentHash)
+		return err
+	})
 
-		block = Deserialize(encodedBlock)
+	if err != nil {
+		return nil, err
+	}
 
+	iter.CurrentHash = block.PrevHash
+
+	return block, nil
+}
+
+// Find all Unspent Transaction Outputs in the blockchain by scanning every block
+// (used to rebuild the UTXO set; queries should use UTXOSet instead)
+func (chain *Blockchain) FindUTXO() ([]UTXO, error) {
+	var UTXOs []UTXO
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		var err error
+		UTXOs, err = findUTXO(txn)
 		return err
 	})
 
-	Handle(err)
+	return UTXOs, err
+}
 
-	iter.CurrentHash = block.PrevHash
+// Call fn on every block of the chain within a database transaction, from the
+// last block down to the genesis block
+func walkChain(txn *badger.Txn, fn func(block *Block)) error {
+	hash, err := getLastHash(txn)
+	if err != nil {
+		return err
+	}
+
+	for len(hash) > 0 {
+		block, err := getBlock(txn, hash)
+		if err != nil {
+			return err
+		}
+		fn(block)
+		hash = block.PrevHash
+	}
 
-	return block
+	return nil
 }
 
-// Find all unspent transactions for a given user
-func (chain *Blockchain) FindUnspentTransactions(pubKeyHash []byte) []Transaction {
-	var unspentTx []Transaction
+// Find all Unspent Transaction Outputs by scanning every block within a database transaction
+func findUTXO(txn *badger.Txn) ([]UTXO, error) {
+	var UTXOs []UTXO
 
-	// Map to store the spent transactions
+	// Map to store the spent transaction outputs
 	spentTXOs := make(map[string][]int)
 
-	iter := chain.Iterator()
+	hash, err := getLastHash(txn)
+	if err != nil {
+		return nil, err
+	}
 
 	for {
 		// Get the next block in the chain
-		block := iter.Next()
+		block, err := getBlock(txn, hash)
+		if err != nil {
+			return nil, err
+		}
 
 		// Iterate through all the transactions present in the block
 		for _, tx := range block.Transactions {
@@ -195,140 +491,153 @@ func (chain *Blockchain) FindUnspentTransactions(pubKeyHash []byte) []Transactio
 			// Iterate through all outputs of a transaction
 		Outputs:
 			for outIdx, out := range tx.Outputs {
-				// If some outputs of the transaction are spent, iterate through them
-				if spentTXOs[txId] != nil {
-					for _, spentOut := range spentTXOs[txId] {
-						// If the current output has already been spent,
-						// directly start iterating with the next output
-						if spentOut == outIdx {
-							continue Outputs
-						}
+				// Blocks are visited from the last one, so an output spent
+				// later in the chain has already been recorded as spent
+				for _, spentOut := range spentTXOs[txId] {
+					if spentOut == outIdx {
+						continue Outputs
 					}
 				}
 
-				// If the output can be unlocked by the calling user,
-				// add it to list of unspent transactions
-				if out.IsLockedWithKey(pubKeyHash) {
-					unspentTx = append(unspentTx, *tx)
-				}
+				UTXOs = append(UTXOs, UTXO{tx.ID, outIdx, out, block.Height, tx.IsCoinbase()})
 			}
 
-			// If the transaction is not a Coinbase Transaction, iterate through its inputs
+			// If the transaction is not a Coinbase Transaction, record the outputs spent by its inputs
 			if tx.IsCoinbase() == false {
 				for _, in := range tx.Inputs {
-					// If the Transaction Input uses the calling user's key,
-					// append it to the list of spent transactions
-					if in.UsesKey(pubKeyHash) {
-						inTxID := hex.EncodeToString(in.ID)
-						spentTXOs[inTxID] = append(spentTXOs[inTxID], in.Out)
-					}
+					inTxID := hex.EncodeToString(in.ID)
+					spentTXOs[inTxID] = append(spentTXOs[inTxID], in.Out)
 				}
 			}
 		}
-		// Exit the loop is coinbase transaction is reached
+		// Exit the loop if genesis block is reached
 		if len(block.PrevHash) == 0 {
 			break
 		}
+		hash = block.PrevHash
 	}
 
-	return unspentTx
+	return UTXOs, nil
 }
 
-// Find all Unspent Transaction Outputs for a user
-func (chain *Blockchain) FindUTXO(pubKeyHash []byte) []TxOutput {
-	var UTXOs []TxOutput
-	// First, find all unspent transaction for the user
-	unspentTransactions := chain.FindUnspentTransactions(pubKeyHash)
-
-	// Iterate through the above transactions and
-	// obtain the unspent outputs for the user
-	for _, tx := range unspentTransactions {
-		for _, out := range tx.Outputs {
-			if out.IsLockedWithKey(pubKeyHash) {
-				UTXOs = append(UTXOs, out)
-			}
-		}
+// Get a block using its hash within a database transaction
+func getBlock(txn *badger.Txn, hash []byte) (*Block, error) {
+	item, err := txn.Get(hash)
+	if err == badger.ErrKeyNotFound {
+		return nil, ErrBlockNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	encodedBlock, err := item.Value()
+	if err != nil {
+		return nil, err
 	}
 
-	return UTXOs
+	return Deserialize(encodedBlock)
 }
 
-// Given a user and amount to be spent, find all possible transaction outputs that can be spent
-func (chain *Blockchain) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[string][]int) {
+// Get a block from the database using its hash
+func (chain *Blockchain) GetBlock(hash []byte) (*Block, error) {
+	var block *Block
 
-	// Store list of spendable outputs
-	unspentOutputs := make(map[string][]int)
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		var err error
+		block, err = getBlock(txn, hash)
+		return err
+	})
 
-	// Find all unspent transaction for the user
-	unspentTransactions := chain.FindUnspentTransactions(pubKeyHash)
-	accumulated := 0 // Store total amount accumulated by combining the unspent transactions
+	return block, err
+}
 
-Work:
-	for _, tx := range unspentTransactions {
-		txId := hex.EncodeToString(tx.ID)
+// Find a transaction and the block containing it within a database transaction, using the transaction index
+func findTransactionBlock(txn *badger.Txn, ID []byte) (Transaction, *Block, error) {
+	item, err := txn.Get(txIndexKey(ID))
+	if err == badger.ErrKeyNotFound {
+		return Transaction{}, nil, ErrTxNotFound
+	} else if err != nil {
+		return Transaction{}, nil, err
+	}
+	encodedLoc, err := item.Value()
+	if err != nil {
+		return Transaction{}, nil, err
+	}
 
-		for outIdx, out := range tx.Outputs {
-			// If transaction output is locked using user's key and
-			// accumulated amount is less than amount to be spent,
-			// append this to the spendable outputs and update the accumulated amount
-			if out.IsLockedWithKey(pubKeyHash) && accumulated < amount {
-				accumulated += out.Value
-				unspentOutputs[txId] = append(unspentOutputs[txId], outIdx)
+	loc, err := DeserializeTxLocation(encodedLoc)
+	if err != nil {
+		return Transaction{}, nil, err
+	}
 
-				// check if required amount has already been accumulated
-				if accumulated >= amount {
-					break Work
-				}
-			}
-		}
+	block, err := getBlock(txn, loc.BlockHash)
+	if err != nil {
+		return Transaction{}, nil, err
 	}
 
-	return accumulated, unspentOutputs
+	return *block.Transactions[loc.Position], block, nil
 }
 
-// Find a transaction using its ID from a blockchain
-func (bc *Blockchain) FindTransaction(ID []byte) (Transaction, error) {
-	iter := bc.Iterator()
-	for {
-		block := iter.Next()
+// Find a transaction using its ID, along with the block containing it, using the transaction index
+func (chain *Blockchain) FindTransactionBlock(ID []byte) (Transaction, *Block, error) {
+	var tx Transaction
+	var block *Block
 
-		for _, tx := range block.Transactions {
-			if bytes.Compare(ID, tx.ID) == 0 {
-				return *tx, nil
-			}
-		}
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		var err error
+		tx, block, err = findTransactionBlock(txn, ID)
+		return err
+	})
 
-		if len(block.PrevHash) == 0 {
-			break
-		}
+	return tx, block, err
+}
 
-	}
+// Find a transaction using its ID from a blockchain
+func (bc *Blockchain) FindTransaction(ID []byte) (Transaction, error) {
+	tx, _, err := bc.FindTransactionBlock(ID)
 
-	return Transaction{}, errors.New("Transaction does not exist")
+	return tx, err
 }
 
-// Sign a transaction using the user's private key
-func (bc *Blockchain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey) {
+// Get the transactions whose outputs are spent by the inputs of a transaction, by hex encoded ID
+func (bc *Blockchain) prevTransactions(tx *Transaction) (map[string]Transaction, error) {
 	prevTXs := make(map[string]Transaction)
 
 	for _, in := range tx.Inputs {
 		prevTx, err := bc.FindTransaction(in.ID)
-		Handle(err)
+		if err != nil {
+			return nil, err
+		}
 		prevTXs[hex.EncodeToString(prevTx.ID)] = prevTx
 	}
 
-	tx.Sign(privKey, prevTXs)
+	return prevTXs, nil
 }
 
-// Verify the signature of a transaction
-func (bc *Blockchain) VerifyTransaction(tx *Transaction) bool {
-	prevTXs := make(map[string]Transaction)
+// Sign a transaction using the user's private key
+func (bc *Blockchain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey) error {
+	prevTXs, err := bc.prevTransactions(tx)
+	if err != nil {
+		return err
+	}
 
-	for _, in := range tx.Inputs {
-		prevTx, err := bc.FindTransaction(in.ID)
-		Handle(err)
-		prevTXs[hex.EncodeToString(prevTx.ID)] = prevTx
+	return tx.Sign(privKey, prevTXs)
+}
+
+// Sign every input of a transaction using the private key of the user owning
+// it, taken from the keys indexed by hex encoded public key
+func (bc *Blockchain) SignTransactionInputs(tx *Transaction, keys map[string]ecdsa.PrivateKey) error {
+	prevTXs, err := bc.prevTransactions(tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.SignInputs(keys, prevTXs)
+}
+
+// Verify the signature of a transaction
+func (bc *Blockchain) VerifyTransaction(tx *Transaction) (bool, error) {
+	prevTXs, err := bc.prevTransactions(tx)
+	if err != nil {
+		return false, err
 	}
 
-	return tx.Verify(prevTXs)
+	return tx.Verify(prevTXs), nil
 }
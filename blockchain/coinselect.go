@@ -0,0 +1,227 @@
+package blockchain
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// Error returned when the available outputs do not add up to the amount to be spent
+var ErrInsufficientFunds = errors.New("funds not enough")
+
+// Strategy choosing which unspent outputs a transaction spends
+type CoinSelector interface {
+	// Name under which the strategy can be chosen
+	Name() string
+
+	// Choose among the candidates outputs adding up to at least the target
+	Select(candidates []UTXO, target int) ([]UTXO, error)
+}
+
+// Constructors of the known coin selection strategies by name
+var selectors = map[string]func() CoinSelector{
+	"largest-first":  func() CoinSelector { return LargestFirst{} },
+	"smallest-first": func() CoinSelector { return SmallestFirst{} },
+	"bnb":            func() CoinSelector { return BranchAndBound{MaxTries: 100000} },
+	"random-improve": func() CoinSelector { return RandomImprove{} },
+}
+
+// Name of the coin selection strategy used when none is chosen
+const DefaultCoinSelector = "largest-first"
+
+// Register a coin selection strategy, so that it can be chosen by name
+func RegisterCoinSelector(name string, factory func() CoinSelector) {
+	selectors[name] = factory
+}
+
+// Create a coin selection strategy from its name
+func NewCoinSelector(name string) (CoinSelector, error) {
+	factory, ok := selectors[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown coin selector %q", name)
+	}
+
+	return factory(), nil
+}
+
+// Add up the values of some outputs
+func sumUTXOs(utxos []UTXO) int {
+	sum := 0
+	for _, utxo := range utxos {
+		sum += utxo.Output.Value
+	}
+
+	return sum
+}
+
+// Copy the candidates sorted by value, largest first if desc is set
+func sortedUTXOs(candidates []UTXO, desc bool) []UTXO {
+	sorted := append([]UTXO{}, candidates...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if desc {
+			return sorted[i].Output.Value > sorted[j].Output.Value
+		}
+		return sorted[i].Output.Value < sorted[j].Output.Value
+	})
+
+	return sorted
+}
+
+// Take outputs in the given order until they add up to the target
+func accumulate(ordered []UTXO, target int) ([]UTXO, error) {
+	var selected []UTXO
+	sum := 0
+
+	for _, utxo := range ordered {
+		if sum >= target {
+			break
+		}
+		selected = append(selected, utxo)
+		sum += utxo.Output.Value
+	}
+
+	if sum < target {
+		return nil, ErrInsufficientFunds
+	}
+
+	return selected, nil
+}
+
+// Spend the largest outputs first, using as few inputs as possible
+type LargestFirst struct{}
+
+func (s LargestFirst) Name() string {
+	return "largest-first"
+}
+
+func (s LargestFirst) Select(candidates []UTXO, target int) ([]UTXO, error) {
+	return accumulate(sortedUTXOs(candidates, true), target)
+}
+
+// Spend the smallest outputs first, consolidating dust at the cost of more inputs
+type SmallestFirst struct{}
+
+func (s SmallestFirst) Name() string {
+	return "smallest-first"
+}
+
+func (s SmallestFirst) Select(candidates []UTXO, target int) ([]UTXO, error) {
+	return accumulate(sortedUTXOs(candidates, false), target)
+}
+
+// Search for a set of outputs adding up to exactly the target, so that no
+// change output is needed. The search explores the outputs by decreasing value,
+// cutting branches that overshoot the target or cannot reach it anymore, and
+// gives up after MaxTries steps. Without an exact match, it falls back to
+// spending the largest outputs first.
+type BranchAndBound struct {
+	MaxTries int // Maximum number of steps of the search (no limit if 0)
+}
+
+func (s BranchAndBound) Name() string {
+	return "bnb"
+}
+
+func (s BranchAndBound) Select(candidates []UTXO, target int) ([]UTXO, error) {
+	sorted := sortedUTXOs(candidates, true)
+
+	// remaining[i] is the total value of the outputs from index i on
+	remaining := make([]int, len(sorted)+1)
+	for i := len(sorted) - 1; i >= 0; i-- {
+		remaining[i] = remaining[i+1] + sorted[i].Output.Value
+	}
+
+	if remaining[0] < target {
+		return nil, ErrInsufficientFunds
+	}
+
+	var chosen []int
+	tries := 0
+
+	// Decide for each output in turn whether it is spent, trying to spend it first
+	var search func(i, sum int) bool
+	search = func(i, sum int) bool {
+		tries++
+		switch {
+		case sum == target:
+			return true
+		case sum > target, sum+remaining[i] < target, i == len(sorted):
+			return false
+		case s.MaxTries > 0 && tries > s.MaxTries:
+			return false
+		}
+
+		chosen = append(chosen, i)
+		if search(i+1, sum+sorted[i].Output.Value) {
+			return true
+		}
+		chosen = chosen[:len(chosen)-1]
+
+		return search(i+1, sum)
+	}
+
+	if !search(0, 0) {
+		return LargestFirst{}.Select(candidates, target)
+	}
+
+	var selected []UTXO
+	for _, i := range chosen {
+		selected = append(selected, sorted[i])
+	}
+
+	return selected, nil
+}
+
+// Spend randomly chosen outputs until the target is reached, then keep adding
+// random outputs while they bring the total closer to twice the target, without
+// exceeding three times the target. The change then tends to be of the same
+// size as the payments, which keeps outputs usable instead of creating dust.
+type RandomImprove struct {
+	Rand *rand.Rand // Source of randomness (seeded from the clock if nil)
+}
+
+func (s RandomImprove) Name() string {
+	return "random-improve"
+}
+
+func (s RandomImprove) Select(candidates []UTXO, target int) ([]UTXO, error) {
+	random := s.Rand
+	if random == nil {
+		random = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+
+	shuffled := append([]UTXO{}, candidates...)
+	random.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+
+	selected, err := accumulate(shuffled, target)
+	if err != nil {
+		return nil, err
+	}
+
+	// Improve the selection with the outputs left, in the same random order
+	ideal, limit := 2*target, 3*target
+	sum := sumUTXOs(selected)
+
+	for _, utxo := range shuffled[len(selected):] {
+		next := sum + utxo.Output.Value
+		if next > limit || abs(ideal-next) >= abs(ideal-sum) {
+			continue
+		}
+		selected = append(selected, utxo)
+		sum = next
+	}
+
+	return selected, nil
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+
+	return x
+}
@@ -0,0 +1,128 @@
+package blockchain
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// Build unspent outputs with the given values, each from its own transaction
+func testUTXOs(values ...int) []UTXO {
+	var utxos []UTXO
+	for i, value := range values {
+		utxos = append(utxos, UTXO{[]byte{byte(i)}, 0, TxOutput{value, nil}, 1, false})
+	}
+
+	return utxos
+}
+
+// Get the values of some outputs, in order
+func utxoValues(utxos []UTXO) []int {
+	var values []int
+	for _, utxo := range utxos {
+		values = append(values, utxo.Output.Value)
+	}
+
+	return values
+}
+
+func TestCoinSelectors(t *testing.T) {
+	tests := []struct {
+		name     string
+		selector CoinSelector
+		values   []int
+		target   int
+		selected []int // Values of the selected outputs, in the order they are returned
+		change   int
+	}{
+		{"largest-first", LargestFirst{}, []int{5, 20, 1, 10}, 12, []int{20}, 8},
+		{"largest-first several", LargestFirst{}, []int{5, 20, 1, 10}, 27, []int{20, 10}, 3},
+		{"largest-first all", LargestFirst{}, []int{5, 20, 1, 10}, 36, []int{20, 10, 5, 1}, 0},
+		{"smallest-first", SmallestFirst{}, []int{5, 20, 1, 10}, 12, []int{1, 5, 10}, 4},
+		{"smallest-first single", SmallestFirst{}, []int{5, 20, 1, 10}, 1, []int{1}, 0},
+		{"bnb exact match", BranchAndBound{MaxTries: 100000}, []int{5, 20, 1, 10}, 16, []int{10, 5, 1}, 0},
+		{"bnb exact single", BranchAndBound{MaxTries: 100000}, []int{5, 20, 1, 10}, 10, []int{10}, 0},
+		{"bnb fallback", BranchAndBound{MaxTries: 100000}, []int{4, 8, 16}, 13, []int{16}, 3},
+		{"bnb fallback after max tries", BranchAndBound{MaxTries: 1}, []int{5, 20, 1, 10}, 16, []int{20}, 4},
+		{"random-improve", RandomImprove{rand.New(rand.NewSource(1))}, []int{5, 20, 1, 10, 3, 8}, 12, []int{8, 5, 20}, 21},
+		{"random-improve other seed", RandomImprove{rand.New(rand.NewSource(2))}, []int{5, 20, 1, 10, 3, 8}, 12, []int{1, 3, 10, 5, 8}, 15},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			selected, err := test.selector.Select(testUTXOs(test.values...), test.target)
+			if err != nil {
+				t.Fatalf("Select failed: %v", err)
+			}
+
+			if values := utxoValues(selected); !reflect.DeepEqual(values, test.selected) {
+				t.Errorf("selected %v, want %v", values, test.selected)
+			}
+			if change := sumUTXOs(selected) - test.target; change != test.change {
+				t.Errorf("change is %d, want %d", change, test.change)
+			}
+		})
+	}
+}
+
+func TestCoinSelectorsInsufficientFunds(t *testing.T) {
+	selectors := []CoinSelector{
+		LargestFirst{},
+		SmallestFirst{},
+		BranchAndBound{MaxTries: 100000},
+		RandomImprove{rand.New(rand.NewSource(1))},
+	}
+
+	for _, selector := range selectors {
+		if _, err := selector.Select(testUTXOs(5, 20, 1, 10), 37); err != ErrInsufficientFunds {
+			t.Errorf("%s: got error %v, want ErrInsufficientFunds", selector.Name(), err)
+		}
+	}
+}
+
+func TestRandomImprove(t *testing.T) {
+	candidates := testUTXOs(1, 2, 3, 5, 8, 13, 21, 34, 55, 89)
+
+	tests := []struct {
+		seed   int64
+		target int
+	}{
+		{1, 10},
+		{2, 10},
+		{3, 40},
+		{4, 100},
+		{5, 231},
+	}
+
+	for _, test := range tests {
+		selected, err := RandomImprove{rand.New(rand.NewSource(test.seed))}.Select(candidates, test.target)
+		if err != nil {
+			t.Fatalf("seed %d: Select failed: %v", test.seed, err)
+		}
+
+		// The same seed gives the same selection
+		again, _ := RandomImprove{rand.New(rand.NewSource(test.seed))}.Select(candidates, test.target)
+		if !reflect.DeepEqual(selected, again) {
+			t.Errorf("seed %d: selected %v then %v", test.seed, utxoValues(selected), utxoValues(again))
+		}
+
+		// The total covers the target, and the improvement never goes beyond three times
+		// the target unless the outputs needed to reach the target already do
+		sum := sumUTXOs(selected)
+		if sum < test.target {
+			t.Errorf("seed %d: selected %d, less than the target %d", test.seed, sum, test.target)
+		}
+		reached, _ := accumulate(selected, test.target)
+		if sum > 3*test.target && len(reached) != len(selected) {
+			t.Errorf("seed %d: improved the selection up to %d, beyond three times the target %d", test.seed, sum, test.target)
+		}
+
+		seen := make(map[string]bool)
+		for _, utxo := range selected {
+			if seen[string(utxo.TxID)] {
+				t.Errorf("seed %d: output %x selected twice", test.seed, utxo.TxID)
+			}
+			seen[string(utxo.TxID)] = true
+		}
+	}
+}
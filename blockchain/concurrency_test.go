@@ -0,0 +1,129 @@
+package blockchain
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/tezansahu/golang_blockchain/wallet"
+)
+
+// Add blocks from many goroutines while others query the balance of the
+// miner, to be run under the race detector (go test -race ./blockchain)
+func TestConcurrentAddBlockAndBalance(t *testing.T) {
+	const (
+		miners          = 8
+		blocksPerMiner  = 5
+		balanceCheckers = 4
+	)
+
+	dir, err := ioutil.TempDir("", "blockchain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	network, err := GetNetwork("regtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(network.DataDir(dir), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := wallet.MakeWallet(network.Params.AddressVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := string(w.Address())
+	pubKeyHash := wallet.PublicKeyHash(w.PublicKey)
+
+	chain, err := InitBlockchain(dir, network, address, NewChainPoW(network.Params))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.Database.Close()
+
+	var miningWG, checkingWG sync.WaitGroup
+	done := make(chan struct{})
+	errs := make(chan error, miners*blocksPerMiner+balanceCheckers)
+
+	for i := 0; i < miners; i++ {
+		miningWG.Add(1)
+		go func() {
+			defer miningWG.Done()
+			for j := 0; j < blocksPerMiner; j++ {
+				height, err := chain.GetBestHeight()
+				if err != nil {
+					errs <- err
+					return
+				}
+				coinbase, err := CoinbaseTx(address, "", chain.Params.BlockSubsidy(height+1))
+				if err != nil {
+					errs <- err
+					return
+				}
+				if _, err := chain.AddBlock([]*Transaction{coinbase}); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < balanceCheckers; i++ {
+		checkingWG.Add(1)
+		go func() {
+			defer checkingWG.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				balance, immature, err := UTXOSet{chain}.Balance(pubKeyHash)
+				if err != nil {
+					errs <- err
+					return
+				}
+				// The balance always matches a whole number of blocks
+				if total := balance + immature; total%network.Params.Subsidy != 0 {
+					errs <- fmt.Errorf("balance %d is not the reward of a whole number of blocks", total)
+					return
+				}
+			}
+		}()
+	}
+
+	miningWG.Wait()
+	close(done)
+	checkingWG.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+
+	height, err := chain.GetBestHeight()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := miners * blocksPerMiner; height != want {
+		t.Errorf("best height is %d, want %d", height, want)
+	}
+
+	balance, immature, err := UTXOSet{chain}.Balance(pubKeyHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total, want := balance+immature, (height+1)*network.Params.Subsidy; total != want {
+		t.Errorf("balance is %d, want %d", total, want)
+	}
+
+	if _, err := chain.VerifyChain(VerifyUTXO); err != nil {
+		t.Errorf("chain does not verify: %v", err)
+	}
+}
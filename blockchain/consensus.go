@@ -0,0 +1,68 @@
+package blockchain
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+
+	"github.com/dgraph-io/badger"
+)
+
+// Read access to the blocks of a chain, as needed by consensus engines
+type ChainReader interface {
+	GetBlock(hash []byte) (*Block, error)
+}
+
+// Consensus engine deciding how blocks are sealed and which sealed blocks are valid
+type Consensus interface {
+	// Name under which the engine is recorded in the database of a chain
+	Name() string
+
+	// Difficulty of the block following the given parent (nil for the genesis block)
+	Difficulty(chain ChainReader, parent *Block) (int, error)
+
+	// Seal a block whose other fields are all set, filling in its Hash and the
+	// fields proving it was produced according to the engine
+	Seal(ctx context.Context, chain ChainReader, block *Block) error
+
+	// Check the seal of a block, returning the broken rule if it is not valid
+	Verify(chain ChainReader, block *Block) error
+
+	// Amount of work a block adds to its chain; the chain with the most
+	// cumulative work is the one to follow
+	Work(block *Block) *big.Int
+}
+
+// Constructors of the known consensus engines by name, given the chain they will run on
+var engines = map[string]func(chain *Blockchain) Consensus{
+	"pow": func(chain *Blockchain) Consensus {
+		return NewChainPoW(chain.Params)
+	},
+	"poa": func(chain *Blockchain) Consensus {
+		return &PoA{Database: chain.Database, WalletDir: chain.Dir}
+	},
+}
+
+// Register a consensus engine, so that chains recorded as using it can be opened
+func RegisterConsensus(name string, factory func(chain *Blockchain) Consensus) {
+	engines[name] = factory
+}
+
+// Create a consensus engine from its name, for the given chain
+func NewConsensus(name string, chain *Blockchain) (Consensus, error) {
+	factory, ok := engines[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown consensus engine %q", name)
+	}
+
+	return factory(chain), nil
+}
+
+// Access to the blocks of a chain within a database transaction
+type txnReader struct {
+	txn *badger.Txn
+}
+
+func (r txnReader) GetBlock(hash []byte) (*Block, error) {
+	return getBlock(r.txn, hash)
+}
@@ -0,0 +1,72 @@
+package blockchain
+
+import (
+	"time"
+)
+
+// Difficulty of the genesis block of mainnet, and how far ahead of the local
+// clock the timestamp of a block may be
+var (
+	InitialDifficulty = 18
+	MaxFutureDrift    = 2 * time.Hour
+)
+
+// Limits on the difficulty, and on how much it can change in a single retarget
+const (
+	minDifficulty    = 1
+	maxDifficulty    = 255
+	maxRetargetShift = 2 // The work needed for a block changes at most by a factor of 2^maxRetargetShift
+)
+
+// Compute the difficulty of the block following the given block. The difficulty
+// only changes on heights that are a multiple of the retarget interval, based on
+// how long the last blocks of the interval took to mine compared to the target
+// block time (in seconds).
+func nextDifficulty(chain ChainReader, last *Block, interval, blockTime int) (int, error) {
+	height := last.Height + 1
+	if interval <= 1 || height%interval != 0 {
+		return last.Difficulty, nil
+	}
+
+	// Walk back to the first block of the interval
+	first := last
+	for i := 0; i < interval-1; i++ {
+		var err error
+		first, err = chain.GetBlock(first.PrevHash)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return retarget(last.Difficulty, last.Timestamp-first.Timestamp, interval-1, blockTime), nil
+}
+
+// Adjust a difficulty so that blocks which took `actual` seconds to mine over
+// the given number of intervals get closer to the target block time. Since each
+// unit of difficulty doubles the work needed, the difficulty moves by one for
+// every factor of two between the actual and the expected time.
+func retarget(difficulty int, actual int64, intervals, blockTime int) int {
+	expected := int64(blockTime) * int64(intervals)
+	if actual < 1 {
+		actual = 1
+	}
+
+	shift := 0
+	for actual*2 <= expected && shift < maxRetargetShift {
+		actual *= 2
+		shift++
+	}
+	for actual >= expected*2 && shift > -maxRetargetShift {
+		actual /= 2
+		shift--
+	}
+
+	difficulty += shift
+	if difficulty < minDifficulty {
+		difficulty = minDifficulty
+	} else if difficulty > maxDifficulty {
+		difficulty = maxDifficulty
+	}
+
+	return difficulty
+}
@@ -0,0 +1,413 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// Canonical binary encoding of the data stored in the database, also used to
+// hash transactions. Every value has exactly one encoding, so that its hash
+// does not depend on the implementation that produced it.
+//
+// Integers are varints as in encoding/binary, in their shortest form: counts,
+// lengths, versions and flags are unsigned, every other integer is signed
+// (zig-zag encoded). Byte strings are their length followed by their bytes.
+// Fields always come in the following order:
+//
+//	output      = value:varint pubKeyHash:bytes
+//	input       = txID:bytes out:varint signature:bytes pubKey:bytes
+//	transaction = version:uvarint id:bytes inputCount:uvarint input*
+//	              outputCount:uvarint output*
+//	header      = prevHash:bytes merkleRoot:bytes timestamp:varint height:varint
+//	              difficulty:varint nonce:varint extra:bytes signature:bytes
+//	block       = version:uvarint hash:bytes header txCount:uvarint
+//	              (txLength:uvarint transaction)*
+//	utxo        = txID:bytes out:varint output height:varint coinbase:uvarint
+//	mempool     = transaction fee:varint size:varint added:varint
+//	params      = genesisData:bytes addressVersion:uvarint difficulty:varint
+//	              subsidy:varint halvingInterval:varint maxSupply:varint
+//	              allocationCount:uvarint (address:bytes amount:varint)*
+//	              coinbaseMaturity:varint retargetInterval:varint
+//	              targetBlockTime:varint
+//	location    = blockHash:bytes position:varint
+//	poaExtra    = version:uvarint sealer:bytes signerCount:uvarint signer:bytes*
+//	              hasVote:uvarint (voteSigner:bytes authorize:uvarint)?
+//
+// Blocks are hashed as their version followed by their header with an empty
+// signature (version:uvarint header), which covers every field of the header.
+// The version of a block or of a transaction also decides how it is hashed
+// (see BlockVersion and TxVersion).
+
+// Version of the blocks created by this implementation. Blocks of version 0
+// (LegacyBlockVersion) were mined before blocks had a height, a timestamp, a
+// difficulty and a Merkle Tree: their hash only covers the previous hash, the
+// hash of their concatenated transaction IDs, the nonce and the fixed
+// difficulty legacyDifficulty. They keep being hashed that way so that they
+// remain valid.
+const (
+	LegacyBlockVersion = 0
+	BlockVersion       = 1
+)
+
+// Difficulty all legacy blocks were mined with
+const legacyDifficulty = 18
+
+// Version of the encoding of the engine data of PoA blocks
+const PoAExtraVersion = 1
+
+// Version of the transactions created by this implementation, hashed using the
+// canonical encoding. Transactions of version 0 (LegacyTxVersion) were created
+// before it existed, and keep being hashed using gob so that their IDs and
+// signatures remain valid.
+const (
+	LegacyTxVersion = 0
+	TxVersion       = 1
+)
+
+// Errors returned when decoding data that is not in the canonical encoding
+var (
+	ErrMalformedEncoding = errors.New("data is not in the canonical encoding")
+	ErrUnknownVersion    = errors.New("unknown encoding version")
+)
+
+// Writer of values in the canonical encoding
+type encoder struct {
+	buf bytes.Buffer
+}
+
+func (e *encoder) uvarint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	e.buf.Write(buf[:binary.PutUvarint(buf[:], v)])
+}
+
+func (e *encoder) varint(v int64) {
+	var buf [binary.MaxVarintLen64]byte
+	e.buf.Write(buf[:binary.PutVarint(buf[:], v)])
+}
+
+func (e *encoder) bytes(b []byte) {
+	e.uvarint(uint64(len(b)))
+	e.buf.Write(b)
+}
+
+func (e *encoder) bool(b bool) {
+	if b {
+		e.uvarint(1)
+	} else {
+		e.uvarint(0)
+	}
+}
+
+// Reader of values in the canonical encoding. The first error is kept and
+// every later read returns a zero value, so that it is checked only once.
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+
+	// Varints longer than needed are rejected, as they are not canonical
+	var buf [binary.MaxVarintLen64]byte
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 || binary.PutUvarint(buf[:], v) != n {
+		d.err = ErrMalformedEncoding
+		return 0
+	}
+	d.data = d.data[n:]
+
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+
+	var buf [binary.MaxVarintLen64]byte
+	v, n := binary.Varint(d.data)
+	if n <= 0 || binary.PutVarint(buf[:], v) != n {
+		d.err = ErrMalformedEncoding
+		return 0
+	}
+	d.data = d.data[n:]
+
+	return v
+}
+
+func (d *decoder) int() int {
+	return int(d.varint())
+}
+
+// Read a length or a count, which can never exceed the number of bytes left
+// since every element takes at least one byte
+func (d *decoder) length() int {
+	n := d.uvarint()
+	if n > uint64(len(d.data)) {
+		if d.err == nil {
+			d.err = ErrMalformedEncoding
+		}
+		return 0
+	}
+
+	return int(n)
+}
+
+// Read a byte string, copying it out of the data (nil if it is empty)
+func (d *decoder) bytes() []byte {
+	n := d.length()
+	if n == 0 {
+		return nil
+	}
+
+	b := append([]byte{}, d.data[:n]...)
+	d.data = d.data[n:]
+
+	return b
+}
+
+func (d *decoder) bool() bool {
+	switch d.uvarint() {
+	case 0:
+		return false
+	case 1:
+		return true
+	}
+
+	if d.err == nil {
+		d.err = ErrMalformedEncoding
+	}
+	return false
+}
+
+// Check that all of the data has been read without error
+func (d *decoder) finish() error {
+	if d.err == nil && len(d.data) > 0 {
+		d.err = ErrMalformedEncoding
+	}
+
+	return d.err
+}
+
+func encodeOutput(e *encoder, out TxOutput) {
+	e.varint(int64(out.Value))
+	e.bytes(out.PubKeyHash)
+}
+
+func decodeOutput(d *decoder) TxOutput {
+	return TxOutput{d.int(), d.bytes()}
+}
+
+func encodeInput(e *encoder, in TxInput) {
+	e.bytes(in.ID)
+	e.varint(int64(in.Out))
+	e.bytes(in.Signature)
+	e.bytes(in.PubKey)
+}
+
+func decodeInput(d *decoder) TxInput {
+	return TxInput{d.bytes(), d.int(), d.bytes(), d.bytes()}
+}
+
+func encodeTransaction(e *encoder, tx *Transaction) {
+	e.uvarint(uint64(tx.Version))
+	e.bytes(tx.ID)
+
+	e.uvarint(uint64(len(tx.Inputs)))
+	for _, in := range tx.Inputs {
+		encodeInput(e, in)
+	}
+
+	e.uvarint(uint64(len(tx.Outputs)))
+	for _, out := range tx.Outputs {
+		encodeOutput(e, out)
+	}
+}
+
+func decodeTransaction(d *decoder) *Transaction {
+	var tx Transaction
+
+	version := d.uvarint()
+	if version > TxVersion && d.err == nil {
+		d.err = ErrUnknownVersion
+	}
+	tx.Version = int(version)
+	tx.ID = d.bytes()
+
+	for n := d.length(); n > 0; n-- {
+		tx.Inputs = append(tx.Inputs, decodeInput(d))
+	}
+	for n := d.length(); n > 0; n-- {
+		tx.Outputs = append(tx.Outputs, decodeOutput(d))
+	}
+
+	return &tx
+}
+
+func encodeHeader(e *encoder, b *Block) {
+	encodeHeaderPrefix(e, b)
+	e.varint(int64(b.Nonce))
+	e.bytes(b.Extra)
+	e.bytes(b.Signature)
+}
+
+// Encode the fields of the header coming before the nonce
+func encodeHeaderPrefix(e *encoder, b *Block) {
+	e.bytes(b.PrevHash)
+	e.bytes(b.MerkleRoot)
+	e.varint(b.Timestamp)
+	e.varint(int64(b.Height))
+	e.varint(int64(b.Difficulty))
+}
+
+// Encode the header of a block as it is hashed: its version followed by the
+// header without the signature, which signs the hash
+func encodeHashedHeader(e *encoder, b *Block) {
+	header := *b
+	header.Signature = nil
+
+	e.uvarint(uint64(b.Version))
+	encodeHeader(e, &header)
+}
+
+func decodeHeader(d *decoder, b *Block) {
+	b.PrevHash = d.bytes()
+	b.MerkleRoot = d.bytes()
+	b.Timestamp = d.varint()
+	b.Height = d.int()
+	b.Difficulty = d.int()
+	b.Nonce = d.int()
+	b.Extra = d.bytes()
+	b.Signature = d.bytes()
+}
+
+func encodeBlock(e *encoder, b *Block) {
+	e.uvarint(uint64(b.Version))
+	e.bytes(b.Hash)
+	encodeHeader(e, b)
+
+	e.uvarint(uint64(len(b.Transactions)))
+	for _, tx := range b.Transactions {
+		e.bytes(tx.Serialize())
+	}
+}
+
+func decodeBlock(data []byte) (*Block, error) {
+	var block Block
+	d := &decoder{data: data}
+
+	version := d.uvarint()
+	if version > BlockVersion && d.err == nil {
+		return nil, ErrUnknownVersion
+	}
+	block.Version = int(version)
+	block.Hash = d.bytes()
+	decodeHeader(d, &block)
+
+	for n := d.length(); n > 0 && d.err == nil; n-- {
+		tx, err := DeserializeTransaction(d.bytes())
+		if err != nil {
+			return nil, err
+		}
+		block.Transactions = append(block.Transactions, tx)
+	}
+
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+
+	return &block, nil
+}
+
+func encodeUTXO(e *encoder, u UTXO) {
+	e.bytes(u.TxID)
+	e.varint(int64(u.Out))
+	encodeOutput(e, u.Output)
+	e.varint(int64(u.Height))
+	e.bool(u.Coinbase)
+}
+
+func decodeUTXO(d *decoder) UTXO {
+	return UTXO{d.bytes(), d.int(), decodeOutput(d), d.int(), d.bool()}
+}
+
+func encodeMempoolEntry(e *encoder, entry MempoolEntry) {
+	encodeTransaction(e, &entry.Tx)
+	e.varint(int64(entry.Fee))
+	e.varint(int64(entry.Size))
+	e.varint(entry.Added)
+}
+
+func decodeMempoolEntry(d *decoder) MempoolEntry {
+	tx := decodeTransaction(d)
+
+	return MempoolEntry{*tx, d.int(), d.int(), d.varint()}
+}
+
+func encodeChainParams(e *encoder, p ChainParams) {
+	e.bytes([]byte(p.GenesisData))
+	e.uvarint(uint64(p.AddressVersion))
+	e.varint(int64(p.Difficulty))
+	e.varint(int64(p.Subsidy))
+	e.varint(int64(p.HalvingInterval))
+	e.varint(int64(p.MaxSupply))
+
+	e.uvarint(uint64(len(p.Allocations)))
+	for _, alloc := range p.Allocations {
+		e.bytes([]byte(alloc.Address))
+		e.varint(int64(alloc.Amount))
+	}
+
+	e.varint(int64(p.CoinbaseMaturity))
+	e.varint(int64(p.RetargetInterval))
+	e.varint(int64(p.TargetBlockTime))
+}
+
+func encodeTxLocation(e *encoder, loc TxLocation) {
+	e.bytes(loc.BlockHash)
+	e.varint(int64(loc.Position))
+}
+
+func decodeTxLocation(d *decoder) TxLocation {
+	return TxLocation{d.bytes(), d.int()}
+}
+
+func encodePoAExtra(e *encoder, extra poaExtra) {
+	e.uvarint(PoAExtraVersion)
+	e.bytes(extra.Sealer)
+
+	e.uvarint(uint64(len(extra.Signers)))
+	for _, signer := range extra.Signers {
+		e.bytes(signer)
+	}
+
+	e.bool(extra.Vote != nil)
+	if extra.Vote != nil {
+		e.bytes(extra.Vote.Signer)
+		e.bool(extra.Vote.Authorize)
+	}
+}
+
+func decodePoAExtra(data []byte) (poaExtra, error) {
+	var extra poaExtra
+	d := &decoder{data: data}
+
+	if version := d.uvarint(); version != PoAExtraVersion && d.err == nil {
+		return poaExtra{}, ErrUnknownVersion
+	}
+	extra.Sealer = d.bytes()
+
+	for n := d.length(); n > 0; n-- {
+		extra.Signers = append(extra.Signers, d.bytes())
+	}
+
+	if d.bool() {
+		extra.Vote = &SignerVote{d.bytes(), d.bool()}
+	}
+
+	return extra, d.finish()
+}
@@ -0,0 +1,59 @@
+package blockchain
+
+import (
+	"github.com/dgraph-io/badger"
+)
+
+// Size of a transaction in bytes, used to compute its fee rate
+func (tx *Transaction) Size() int {
+	return len(tx.Serialize())
+}
+
+// Get the fee paid by a transaction to the miner of its block, which is the
+// value of its inputs not claimed by any of its outputs
+func (chain *Blockchain) TransactionFee(tx *Transaction) (int, error) {
+	fee := 0
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		var err error
+		fee, err = chain.transactionFee(txn, tx)
+		return err
+	})
+
+	return fee, err
+}
+
+// Compute the fee of a transaction within a database transaction, looking up
+// the outputs its inputs refer to in the chain. It fails with
+// ErrValueOutOfRange if its inputs or outputs exceed the maximum supply.
+func (chain *Blockchain) transactionFee(txn *badger.Txn, tx *Transaction) (int, error) {
+	if tx.IsCoinbase() {
+		return 0, nil
+	}
+
+	inputSum := 0
+	for _, in := range tx.Inputs {
+		prevTx, _, err := findTransactionBlock(txn, in.ID)
+		if err != nil {
+			return 0, err
+		}
+		if in.Out < 0 || in.Out >= len(prevTx.Outputs) {
+			return 0, ErrInvalidOutput
+		}
+		value := prevTx.Outputs[in.Out].Value
+		if !chain.Params.moneyRange(value) || !chain.Params.moneyRange(inputSum+value) {
+			return 0, ErrValueOutOfRange
+		}
+		inputSum += value
+	}
+
+	outputSum := 0
+	for _, out := range tx.Outputs {
+		if !chain.Params.moneyRange(out.Value) || !chain.Params.moneyRange(outputSum+out.Value) {
+			return 0, ErrValueOutOfRange
+		}
+		outputSum += out.Value
+	}
+
+	return inputSum - outputSum, nil
+}
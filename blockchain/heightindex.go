@@ -0,0 +1,70 @@
+package blockchain
+
+import (
+	"github.com/dgraph-io/badger"
+)
+
+// Prefix of the keys under which the height index is stored in the database
+var heightIndexPrefix = []byte("height-")
+
+// Create the database key of a block height in the index
+func heightIndexKey(height int) []byte {
+	return append(append([]byte{}, heightIndexPrefix...), ToHex(int64(height))...)
+}
+
+// Add a block to the height index within a database transaction
+func indexHeight(txn *badger.Txn, block *Block) error {
+	return txn.Set(heightIndexKey(block.Height), block.Hash)
+}
+
+// Get the hash of the block at the given height using the height index
+func (chain *Blockchain) GetBlockHash(height int) ([]byte, error) {
+	var hash []byte
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(heightIndexKey(height))
+		if err == badger.ErrKeyNotFound {
+			return ErrBlockNotFound
+		} else if err != nil {
+			return err
+		}
+		hash, err = item.ValueCopy(nil)
+
+		return err
+	})
+
+	return hash, err
+}
+
+// Get the block at the given height
+func (chain *Blockchain) GetBlockByHeight(height int) (*Block, error) {
+	hash, err := chain.GetBlockHash(height)
+	if err != nil {
+		return nil, err
+	}
+
+	return chain.GetBlock(hash)
+}
+
+// Get the height of the last block in the chain
+func (chain *Blockchain) GetBestHeight() (int, error) {
+	lastBlock, err := chain.GetBlock(chain.LastHash())
+	if err != nil {
+		return 0, err
+	}
+
+	return lastBlock.Height, nil
+}
+
+// Rebuild the height index from scratch by scanning the whole blockchain
+func (chain *Blockchain) ReindexHeights() error {
+	return chain.rebuildIndex(heightIndexPrefix, func(txn *badger.Txn) (map[string][]byte, error) {
+		entries := make(map[string][]byte)
+
+		err := walkChain(txn, func(block *Block) {
+			entries[string(heightIndexKey(block.Height))] = block.Hash
+		})
+
+		return entries, err
+	})
+}
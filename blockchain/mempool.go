@@ -0,0 +1,404 @@
+package blockchain
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/dgraph-io/badger"
+)
+
+// Prefixes of the keys under which the mempool is stored in the database: the
+// pending transactions by ID, and the outputs they spend by outpoint
+var (
+	mempoolPrefix      = []byte("mempool-tx-")
+	mempoolSpentPrefix = []byte("mempool-spent-")
+)
+
+// Limits of the mempool
+var (
+	MempoolMaxBytes = 4 << 20        // Total size of the pending transactions, beyond which the lowest fee rates are evicted
+	MempoolExpiry   = 72 * time.Hour // Time after which a pending transaction is evicted
+	MaxBlockBytes   = 1 << 20        // Total size of the pending transactions selected for a block
+)
+
+// Errors describing why a transaction was not accepted into, or found in, the mempool
+var (
+	ErrAlreadyPending  = errors.New("transaction is already in the mempool")
+	ErrMempoolConflict = errors.New("transaction spends an output already spent by a pending transaction")
+	ErrMempoolFull     = errors.New("mempool is full of transactions paying a higher fee rate")
+	ErrNotPending      = errors.New("transaction is not in the mempool")
+)
+
+// Structure of a pending transaction in the mempool
+type MempoolEntry struct {
+	Tx    Transaction
+	Fee   int   // Fee left to the miner of the block including the transaction
+	Size  int   // Size of the transaction in bytes
+	Added int64 // Unix time at which the transaction entered the mempool
+}
+
+// Pool of validated transactions waiting to be included in a block, kept in the
+// database so that it survives restarts. Pending transactions never spend the
+// same output, nor an output of another pending transaction.
+type Mempool struct {
+	Blockchain *Blockchain
+}
+
+func mempoolKey(txID []byte) []byte {
+	return append(append([]byte{}, mempoolPrefix...), txID...)
+}
+
+func mempoolSpentKey(txID []byte, out int) []byte {
+	return append(append([]byte{}, mempoolSpentPrefix...), utxoKey(txID, out)...)
+}
+
+// Function to serialize a mempool entry into bytes, using the canonical encoding
+func (e MempoolEntry) Serialize() []byte {
+	var enc encoder
+	encodeMempoolEntry(&enc, e)
+
+	return enc.buf.Bytes()
+}
+
+// Function to deserialize a mempool entry from bytes
+func DeserializeMempoolEntry(data []byte) (MempoolEntry, error) {
+	d := &decoder{data: data}
+	entry := decodeMempoolEntry(d)
+
+	return entry, d.finish()
+}
+
+// Get the fee rate of a pending transaction, in tokens per kilobyte (1000 bytes)
+func (e MempoolEntry) FeeRate() float64 {
+	return float64(e.Fee) * 1000 / float64(e.Size)
+}
+
+// Check if an entry should be mined before another one: it pays a higher fee
+// rate or, at equal fee rates, it has been waiting for longer
+func (e MempoolEntry) before(other MempoolEntry) bool {
+	// Compare e.Fee/e.Size with other.Fee/other.Size without rounding
+	if a, b := e.Fee*other.Size, other.Fee*e.Size; a != b {
+		return a > b
+	}
+
+	return e.Added < other.Added
+}
+
+// Check if an entry has been waiting for longer than MempoolExpiry
+func (e MempoolEntry) expired(now time.Time) bool {
+	return now.Sub(time.Unix(e.Added, 0)) > MempoolExpiry
+}
+
+// Get all entries of the mempool within a database transaction, by decreasing priority
+func mempoolEntries(txn *badger.Txn) ([]MempoolEntry, error) {
+	var entries []MempoolEntry
+
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+
+	for it.Seek(mempoolPrefix); it.ValidForPrefix(mempoolPrefix); it.Next() {
+		v, err := it.Item().Value()
+		if err != nil {
+			return nil, err
+		}
+		entry, err := DeserializeMempoolEntry(v)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].before(entries[j])
+	})
+
+	return entries, nil
+}
+
+// Get an entry of the mempool within a database transaction
+func getMempoolEntry(txn *badger.Txn, txID []byte) (MempoolEntry, error) {
+	item, err := txn.Get(mempoolKey(txID))
+	if err != nil {
+		return MempoolEntry{}, err
+	}
+	v, err := item.Value()
+	if err != nil {
+		return MempoolEntry{}, err
+	}
+
+	return DeserializeMempoolEntry(v)
+}
+
+// Store an entry in the mempool within a database transaction, along with the outputs it spends
+func putMempoolEntry(txn *badger.Txn, entry MempoolEntry) error {
+	for _, in := range entry.Tx.Inputs {
+		if err := txn.Set(mempoolSpentKey(in.ID, in.Out), entry.Tx.ID); err != nil {
+			return err
+		}
+	}
+
+	return txn.Set(mempoolKey(entry.Tx.ID), entry.Serialize())
+}
+
+// Delete an entry from the mempool within a database transaction, along with the outputs it spends
+func deleteMempoolEntry(txn *badger.Txn, entry MempoolEntry) error {
+	for _, in := range entry.Tx.Inputs {
+		if err := txn.Delete(mempoolSpentKey(in.ID, in.Out)); err != nil {
+			return err
+		}
+	}
+
+	return txn.Delete(mempoolKey(entry.Tx.ID))
+}
+
+// Remove from the mempool within a database transaction the transactions
+// included in a block, as well as those conflicting with them
+func removeMined(txn *badger.Txn, block *Block) error {
+	for _, tx := range block.Transactions {
+		if entry, err := getMempoolEntry(txn, tx.ID); err == nil {
+			if err := deleteMempoolEntry(txn, entry); err != nil {
+				return err
+			}
+		} else if err != badger.ErrKeyNotFound {
+			return err
+		}
+
+		if tx.IsCoinbase() {
+			continue
+		}
+
+		// Any other pending transaction spending the same outputs can never be mined
+		for _, in := range tx.Inputs {
+			item, err := txn.Get(mempoolSpentKey(in.ID, in.Out))
+			if err == badger.ErrKeyNotFound {
+				continue
+			} else if err != nil {
+				return err
+			}
+			conflictID, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+
+			entry, err := getMempoolEntry(txn, conflictID)
+			if err != nil {
+				return err
+			}
+			if err := deleteMempoolEntry(txn, entry); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Validate a transaction against the chain and the pending transactions, and
+// add it to the mempool. Expired transactions are evicted, and so are the
+// transactions with the lowest fee rates when the mempool grows too large.
+func (pool Mempool) Add(tx *Transaction) (MempoolEntry, error) {
+	var entry MempoolEntry
+
+	err := pool.Blockchain.update(func(txn *badger.Txn) error {
+		if tx.IsCoinbase() {
+			return &ValidationError{nil, tx.ID, ErrInvalidCoinbase}
+		}
+
+		if _, err := txn.Get(mempoolKey(tx.ID)); err == nil {
+			return &ValidationError{nil, tx.ID, ErrAlreadyPending}
+		} else if err != badger.ErrKeyNotFound {
+			return err
+		}
+
+		for _, in := range tx.Inputs {
+			if _, err := txn.Get(mempoolSpentKey(in.ID, in.Out)); err == nil {
+				return &ValidationError{nil, tx.ID, ErrMempoolConflict}
+			} else if err != badger.ErrKeyNotFound {
+				return err
+			}
+		}
+
+		// Pending transactions must be valid in the next block
+		lastBlock, err := getLastBlock(txn)
+		if err != nil {
+			return err
+		}
+
+		fee, err := pool.Blockchain.validateTransaction(txn, lastBlock.Height+1, tx, make(map[string]bool), make(map[string]Transaction))
+		if err != nil {
+			return err
+		}
+		entry = MempoolEntry{*tx, fee, tx.Size(), time.Now().Unix()}
+
+		pending, err := expireMempool(txn)
+		if err != nil {
+			return err
+		}
+
+		total := entry.Size
+		for _, e := range pending {
+			total += e.Size
+		}
+
+		// Make room by evicting the pending transactions with the lowest priority,
+		// as long as they come after the new one
+		for total > MempoolMaxBytes && len(pending) > 0 {
+			lowest := pending[len(pending)-1]
+			if !entry.before(lowest) {
+				break
+			}
+			if err := deleteMempoolEntry(txn, lowest); err != nil {
+				return err
+			}
+			total -= lowest.Size
+			pending = pending[:len(pending)-1]
+		}
+
+		if total > MempoolMaxBytes {
+			return &ValidationError{nil, tx.ID, ErrMempoolFull}
+		}
+
+		return putMempoolEntry(txn, entry)
+	})
+
+	return entry, err
+}
+
+// Evict the expired transactions from the mempool within a database
+// transaction, and return the remaining ones by decreasing priority
+func expireMempool(txn *badger.Txn) ([]MempoolEntry, error) {
+	entries, err := mempoolEntries(txn)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var pending []MempoolEntry
+	for _, e := range entries {
+		if e.expired(now) {
+			if err := deleteMempoolEntry(txn, e); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		pending = append(pending, e)
+	}
+
+	return pending, nil
+}
+
+// Evict the expired transactions from the mempool and return the remaining
+// ones, by decreasing priority
+func (pool Mempool) Entries() ([]MempoolEntry, error) {
+	var entries []MempoolEntry
+
+	err := pool.Blockchain.update(func(txn *badger.Txn) error {
+		var err error
+		entries, err = expireMempool(txn)
+		return err
+	})
+
+	return entries, err
+}
+
+// Remove a transaction from the mempool
+func (pool Mempool) Remove(txID []byte) error {
+	return pool.Blockchain.update(func(txn *badger.Txn) error {
+		entry, err := getMempoolEntry(txn, txID)
+		if err == badger.ErrKeyNotFound {
+			return ErrNotPending
+		} else if err != nil {
+			return err
+		}
+
+		return deleteMempoolEntry(txn, entry)
+	})
+}
+
+// Get the outputs spent by pending transactions, by database key in the UTXO
+// set, so that new transactions do not try to spend them again
+func (pool Mempool) SpentOutputs() (map[string]bool, error) {
+	var spent map[string]bool
+
+	err := pool.Blockchain.Database.View(func(txn *badger.Txn) error {
+		var err error
+		spent, err = mempoolSpentOutputs(txn)
+		return err
+	})
+
+	return spent, err
+}
+
+// Get the outputs spent by pending transactions within a database transaction
+func mempoolSpentOutputs(txn *badger.Txn) (map[string]bool, error) {
+	spent := make(map[string]bool)
+
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	for it.Seek(mempoolSpentPrefix); it.ValidForPrefix(mempoolSpentPrefix); it.Next() {
+		spent[string(it.Item().Key()[len(mempoolSpentPrefix):])] = true
+	}
+
+	return spent, nil
+}
+
+// Select pending transactions to be mined in the next block, by decreasing
+// priority and up to the given total size, and return them with their total
+// fee. Transactions that are no longer valid on top of the chain are skipped.
+func (pool Mempool) Select(maxBytes int) ([]*Transaction, int, error) {
+	var txs []*Transaction
+	var fees int
+
+	err := pool.Blockchain.Database.View(func(txn *badger.Txn) error {
+		lastBlock, err := getLastBlock(txn)
+		if err != nil {
+			return err
+		}
+
+		txs, fees, err = pool.Blockchain.selectMempool(txn, lastBlock.Height+1, maxBytes)
+		return err
+	})
+
+	return txs, fees, err
+}
+
+// Select pending transactions like Select within a database transaction, for
+// the block at the given height
+func (chain *Blockchain) selectMempool(txn *badger.Txn, height, maxBytes int) ([]*Transaction, int, error) {
+	var txs []*Transaction
+	fees := 0
+
+	entries, err := mempoolEntries(txn)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	spent := make(map[string]bool)
+	seen := make(map[string]Transaction)
+	size := 0
+	now := time.Now()
+
+	for i := range entries {
+		entry := entries[i]
+		if entry.expired(now) || size+entry.Size > maxBytes {
+			continue
+		}
+
+		fee, err := chain.validateTransaction(txn, height, &entry.Tx, spent, seen)
+		if _, invalid := err.(*ValidationError); invalid {
+			continue
+		} else if err != nil {
+			return nil, 0, err
+		}
+
+		txs = append(txs, &entry.Tx)
+		fees += fee
+		size += entry.Size
+	}
+
+	return txs, fees, nil
+}
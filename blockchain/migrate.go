@@ -0,0 +1,201 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/dgraph-io/badger"
+	"github.com/tezansahu/golang_blockchain/wallet"
+)
+
+// Version of the format of the database: 0 when blocks, transactions and UTXO
+// set entries were gob encoded, 1 since they use the canonical encoding
+const DBVersion = 1
+
+// Key under which the version of the format of the database is stored
+var dbVersionKey = []byte("dbversion")
+
+// Get the version of the format of the database within a database transaction
+func getDBVersion(txn *badger.Txn) (int, error) {
+	item, err := txn.Get(dbVersionKey)
+	if err == badger.ErrKeyNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	v, err := item.Value()
+	if err != nil {
+		return 0, err
+	}
+
+	version, n := binary.Uvarint(v)
+	if n <= 0 {
+		return 0, ErrMalformedEncoding
+	}
+
+	return int(version), nil
+}
+
+// Record the version of the format of the database within a database transaction
+func setDBVersion(txn *badger.Txn, version int) error {
+	var e encoder
+	e.uvarint(uint64(version))
+
+	return txn.Set(dbVersionKey, e.buf.Bytes())
+}
+
+// Check whether the data directory holds the database of a blockchain created
+// before each network had its own subdirectory, which then belongs to the
+// default network
+func legacyDBExists(dataDir string, network Network) bool {
+	if network.Name != DefaultNetwork {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(dataDir, dbFile))
+
+	return err == nil
+}
+
+// Report a database left in the data directory from before each network had
+// its own subdirectory
+func legacyDBError(dataDir string) error {
+	return fmt.Errorf("%w: found in %s", ErrOutdatedDatabase, filepath.Join(dataDir, dbPath))
+}
+
+// Move the database and the wallets file created before each network had its
+// own subdirectory into the directory of the default network
+func moveLegacyDB(dataDir string, network Network) error {
+	if err := os.MkdirAll(network.DataDir(dataDir), 0755); err != nil {
+		return err
+	}
+	if err := wallet.MoveLegacyWallets(dataDir, network.DataDir(dataDir)); err != nil {
+		return err
+	}
+
+	return os.Rename(filepath.Join(dataDir, dbPath), filepath.Join(network.DataDir(dataDir), dbPath))
+}
+
+// Rewrite the database of a network in the data directory if it was created
+// before the canonical encoding: the blocks of the chain are decoded from gob
+// and encoded again, and the UTXO set, the transaction index and the height
+// index are then rebuilt from the chain. Blocks keep their hash, being marked
+// as LegacyBlockVersion, and their transactions keep their IDs and signatures,
+// being marked as LegacyTxVersion. Blocks already in the canonical encoding are
+// left as they are, so that an interrupted migration can simply be run again.
+// Return the number of blocks rewritten. A database from before each network
+// had its own subdirectory is first moved into the directory of the default
+// network, along with its wallets.
+func MigrateDatabase(dataDir string, network Network) (int, error) {
+	if !DBexists(dataDir, network) {
+		if !legacyDBExists(dataDir, network) {
+			return 0, ErrChainNotFound
+		}
+		if err := moveLegacyDB(dataDir, network); err != nil {
+			return 0, err
+		}
+	}
+
+	db, err := openDB(dataDir, network)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	entries := make(map[string][]byte)
+	var lastHash []byte
+	var chain []*Block // Blocks of the chain, from the last one
+	var legacy []bool  // Whether each block of the chain was gob encoded
+
+	err = db.View(func(txn *badger.Txn) error {
+		version, err := getDBVersion(txn)
+		if err != nil || version >= DBVersion {
+			return err
+		}
+
+		// Follow the chain from its last block down to the genesis block
+		if lastHash, err = getLastHash(txn); err != nil {
+			return err
+		}
+
+		for hash := lastHash; len(hash) > 0; {
+			item, err := txn.Get(hash)
+			if err != nil {
+				return err
+			}
+			v, err := item.Value()
+			if err != nil {
+				return err
+			}
+
+			block, err := decodeBlock(v)
+			gobEncoded := err != nil
+			if gobEncoded {
+				if block, err = decodeLegacyBlock(v); err != nil {
+					return err
+				}
+			}
+			chain = append(chain, block)
+			legacy = append(legacy, gobEncoded)
+			hash = block.PrevHash
+		}
+
+		return nil
+	})
+
+	if err != nil || lastHash == nil {
+		return 0, err
+	}
+
+	blocks := 0
+	for i, block := range chain {
+		if !legacy[i] {
+			continue
+		}
+
+		// Legacy blocks had no height, which is given by their position in the chain
+		block.Version = LegacyBlockVersion
+		block.Height = len(chain) - 1 - i
+		block.Difficulty = legacyDifficulty
+		block.MerkleRoot = block.HashTransactions()
+		entries[string(block.Hash)] = block.Serialize()
+		blocks++
+	}
+
+	if err := writeBatch(db, entries); err != nil {
+		return 0, err
+	}
+
+	// The UTXO set was gob encoded and the other indexes did not exist
+	indexed := &Blockchain{Database: db, lastHash: lastHash}
+	if err := (UTXOSet{indexed}).Reindex(); err != nil {
+		return 0, err
+	}
+	if err := indexed.ReindexTransactions(); err != nil {
+		return 0, err
+	}
+	if err := indexed.ReindexHeights(); err != nil {
+		return 0, err
+	}
+
+	err = db.Update(func(txn *badger.Txn) error {
+		return setDBVersion(txn, DBVersion)
+	})
+
+	return blocks, err
+}
+
+// Decode a block stored before the canonical encoding existed. Neither the
+// block nor its transactions have a version, so they are decoded as
+// LegacyBlockVersion and LegacyTxVersion.
+func decodeLegacyBlock(data []byte) (*Block, error) {
+	var block Block
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+
+	err := decoder.Decode(&block)
+
+	return &block, err
+}
@@ -0,0 +1,47 @@
+package blockchain
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// Profile of a network. Each network keeps its blocks and wallets in its own
+// subdirectory of the data directory, and has its own default chain parameters
+// (genesis data, address version byte, difficulty...), so that chains of
+// different networks are never mixed up. The difficulty of regtest chains never
+// changes, so that blocks can always be mined instantly.
+type Network struct {
+	Name   string
+	Dir    string      // Subdirectory of the data directory holding the data of the network
+	Params ChainParams // Parameters of chains created without a genesis file
+}
+
+// Known network profiles by name
+var networks = map[string]Network{
+	"mainnet": {"mainnet", "mainnet", ChainParams{"First Transaction from Genesis", 0x00, InitialDifficulty, 100, 210000, 42000000, 100, 10, 10, nil}},
+	"testnet": {"testnet", "testnet", ChainParams{"First Transaction from Testnet Genesis", 0x6f, 12, 100, 210000, 42000000, 100, 10, 10, nil}},
+	"regtest": {"regtest", "regtest", ChainParams{"First Transaction from Regtest Genesis", 0x6f, minDifficulty, 100, 150, 42000000, 100, 0, 10, nil}},
+}
+
+// Name of the network used when none is chosen
+const DefaultNetwork = "mainnet"
+
+// Register a network profile, so that it can be chosen by name
+func RegisterNetwork(network Network) {
+	networks[network.Name] = network
+}
+
+// Get a network profile from its name
+func GetNetwork(name string) (Network, error) {
+	network, ok := networks[name]
+	if !ok {
+		return Network{}, fmt.Errorf("Unknown network %q", name)
+	}
+
+	return network, nil
+}
+
+// Get the directory holding the data of the network within the given data directory
+func (n Network) DataDir(dataDir string) string {
+	return filepath.Join(dataDir, n.Dir)
+}
@@ -0,0 +1,164 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/tezansahu/golang_blockchain/wallet"
+)
+
+// Parameters of a chain, fixed when its genesis block is created. They can be
+// read from a JSON genesis file, and their hash is recorded in the database so
+// that a node configured with other parameters refuses to open the chain.
+type ChainParams struct {
+	GenesisData      string      `json:"genesisData"`      // Data of the coinbase transaction of the genesis block
+	AddressVersion   byte        `json:"addressVersion"`   // Version byte of the addresses of the chain
+	Difficulty       int         `json:"difficulty"`       // Difficulty of the genesis block of PoW chains
+	Subsidy          int         `json:"subsidy"`          // Subsidy of a block before the first halving
+	HalvingInterval  int         `json:"halvingInterval"`  // Number of blocks between two halvings of the subsidy
+	MaxSupply        int         `json:"maxSupply"`        // Maximum number of tokens ever issued, allocations included
+	CoinbaseMaturity int         `json:"coinbaseMaturity"` // Number of blocks before the outputs of a coinbase can be spent
+	RetargetInterval int         `json:"retargetInterval"` // Number of blocks between two changes of the difficulty of PoW chains (0 never changes it)
+	TargetBlockTime  int         `json:"targetBlockTime"`  // Desired number of seconds between two consecutive blocks of PoW chains
+	Allocations      []Recipient `json:"allocations"`      // Initial balances, paid by the coinbase of the genesis block
+}
+
+// Name of the file in the data directory of a network recording the
+// parameters its chain was created with
+const genesisFile = "genesis.json"
+
+// Key under which the hash of the parameters of the chain is stored in the database
+var paramsKey = []byte("params")
+
+// Errors returned when chain parameters cannot be used
+var (
+	ErrInvalidChainParams = errors.New("invalid chain parameters")
+	ErrParamsMismatch     = errors.New("chain was created with other chain parameters")
+)
+
+// Read chain parameters from a JSON genesis file. Parameters missing from the
+// file keep their value in defaults.
+func LoadChainParams(path string, defaults ChainParams) (ChainParams, error) {
+	params := defaults
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ChainParams{}, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&params); err != nil {
+		return ChainParams{}, fmt.Errorf("%s: %v", path, err)
+	}
+
+	if err := params.Validate(); err != nil {
+		return ChainParams{}, err
+	}
+
+	return params, nil
+}
+
+// Write chain parameters to a JSON genesis file
+func (p ChainParams) Save(path string) error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// Get the parameters of the chain of a network in the data directory: those
+// recorded in its genesis file when it was created, or else the defaults of the network
+func NetworkParams(dataDir string, network Network) (ChainParams, error) {
+	path := filepath.Join(network.DataDir(dataDir), genesisFile)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return network.Params, nil
+	}
+
+	return LoadChainParams(path, network.Params)
+}
+
+// Check that the parameters describe a chain that can be created
+func (p ChainParams) Validate() error {
+	switch {
+	case p.Difficulty < minDifficulty || p.Difficulty > maxDifficulty:
+		return fmt.Errorf("%w: difficulty must be between %d and %d", ErrInvalidChainParams, minDifficulty, maxDifficulty)
+	case p.Subsidy < 0:
+		return fmt.Errorf("%w: subsidy must not be negative", ErrInvalidChainParams)
+	case p.HalvingInterval <= 0:
+		return fmt.Errorf("%w: halving interval must be positive", ErrInvalidChainParams)
+	case p.MaxSupply < 0:
+		return fmt.Errorf("%w: maximum supply must not be negative", ErrInvalidChainParams)
+	case p.CoinbaseMaturity < 0:
+		return fmt.Errorf("%w: coinbase maturity must not be negative", ErrInvalidChainParams)
+	case p.RetargetInterval < 0:
+		return fmt.Errorf("%w: retarget interval must not be negative", ErrInvalidChainParams)
+	case p.TargetBlockTime <= 0:
+		return fmt.Errorf("%w: target block time must be positive", ErrInvalidChainParams)
+	}
+
+	allocated := 0
+	for _, alloc := range p.Allocations {
+		if err := wallet.ValidateAddress(alloc.Address, p.AddressVersion); err != nil {
+			return fmt.Errorf("%w: allocation to %v", ErrInvalidChainParams, err)
+		}
+		if alloc.Amount <= 0 {
+			return fmt.Errorf("%w: allocation to %s must be positive", ErrInvalidChainParams, alloc.Address)
+		}
+		allocated += alloc.Amount
+	}
+
+	if allocated > p.MaxSupply {
+		return fmt.Errorf("%w: allocations exceed the maximum supply", ErrInvalidChainParams)
+	}
+
+	return nil
+}
+
+// Hash the parameters, using their canonical encoding
+func (p ChainParams) Hash() []byte {
+	var e encoder
+	encodeChainParams(&e, p)
+
+	hash := sha256.Sum256(e.buf.Bytes())
+
+	return hash[:]
+}
+
+// Total of the initial balances
+func (p ChainParams) allocated() int {
+	total := 0
+	for _, alloc := range p.Allocations {
+		total += alloc.Amount
+	}
+
+	return total
+}
+
+// Create the coinbase transaction of the genesis block, paying the initial
+// balances and rewarding the given user with the rest of its subsidy
+func GenesisTx(to string, params ChainParams) (*Transaction, error) {
+	txn, err := CoinbaseTx(to, params.GenesisData, params.BlockSubsidy(0)-params.allocated())
+	if err != nil {
+		return nil, err
+	}
+
+	for _, alloc := range params.Allocations {
+		out, err := NewTXOutput(alloc.Amount, alloc.Address)
+		if err != nil {
+			return nil, err
+		}
+		txn.Outputs = append(txn.Outputs, *out)
+	}
+	txn.ID = txn.Hash()
+
+	return txn, nil
+}
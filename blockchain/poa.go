@@ -0,0 +1,438 @@
+package blockchain
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+
+	"github.com/dgraph-io/badger"
+	"github.com/tezansahu/golang_blockchain/wallet"
+)
+
+// Errors describing why a block was rejected by the PoA engine
+var (
+	ErrInvalidSeal        = errors.New("block is not correctly signed by its sealer")
+	ErrUnauthorizedSigner = errors.New("block is sealed by a key that is not an authorized signer")
+	ErrOutOfTurnSigner    = errors.New("block is sealed by a signer whose turn it is not")
+	ErrNoSignerKey        = errors.New("no local wallet holds the key of the signer in turn")
+)
+
+// Prefix of the keys under which the signer proposals of this node are stored in the database
+var proposalPrefix = []byte("poa-proposal-")
+
+// Vote carried by a block to add a signer to, or remove a signer from, the set of authorities
+type SignerVote struct {
+	Signer    []byte // Public key of the signer the vote is about
+	Authorize bool   // Whether to add the signer (true) or remove it (false)
+}
+
+// Engine data of a PoA block, stored in its Extra field
+type poaExtra struct {
+	Sealer  []byte      // Public key of the signer that sealed the block
+	Signers [][]byte    // Initial set of signers (genesis block only)
+	Vote    *SignerVote // Vote of the sealer, if any (never in the genesis block)
+}
+
+// Consensus engine where a set of authorized signers, identified by their
+// wallet public keys, take turns sealing blocks by signing them with ECDSA.
+// Signers are added or removed once a majority of them voted for it in the
+// blocks they sealed.
+type PoA struct {
+	Signers   [][]byte   // Initial signers, written into the genesis block when sealing it
+	Database  *badger.DB // Database holding the signer proposals of this node
+	WalletDir string     // Directory of the wallets file holding the keys of the signers of this node
+
+	lock      sync.Mutex
+	snapshots map[string]*Snapshot // Snapshots by hash of the block they follow
+}
+
+// Set of signers authorized after a given block, along with the votes cast so far
+type Snapshot struct {
+	Signers [][]byte                   // Authorized signers, sorted
+	Votes   map[string]map[string]bool // Signers (hex keys) that voted for each proposal
+}
+
+// Create a PoA engine for a new chain with the given initial signers
+func NewPoA(signers [][]byte, walletDir string) *PoA {
+	return &PoA{Signers: signers, WalletDir: walletDir}
+}
+
+// Create the snapshot of a set of signers before any vote
+func newSnapshot(signers [][]byte) *Snapshot {
+	snap := &Snapshot{nil, make(map[string]map[string]bool)}
+	for _, signer := range signers {
+		if !snap.IsSigner(signer) {
+			snap.Signers = append(snap.Signers, signer)
+		}
+	}
+	snap.sortSigners()
+
+	return snap
+}
+
+func (snap *Snapshot) sortSigners() {
+	sort.Slice(snap.Signers, func(i, j int) bool {
+		return bytes.Compare(snap.Signers[i], snap.Signers[j]) < 0
+	})
+}
+
+// Check if a public key belongs to an authorized signer
+func (snap *Snapshot) IsSigner(signer []byte) bool {
+	for _, s := range snap.Signers {
+		if bytes.Compare(s, signer) == 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Get the signer whose turn it is to seal the block at the given height
+func (snap *Snapshot) InTurn(height int) []byte {
+	return snap.Signers[height%len(snap.Signers)]
+}
+
+// Key identifying a proposal in the tally of votes
+func voteKey(vote *SignerVote) string {
+	return fmt.Sprintf("%x:%t", vote.Signer, vote.Authorize)
+}
+
+// Create the snapshot following a block sealed by the given signer, carrying the given vote
+func (snap *Snapshot) apply(sealer []byte, vote *SignerVote) *Snapshot {
+	next := &Snapshot{append([][]byte{}, snap.Signers...), make(map[string]map[string]bool)}
+	for key, voters := range snap.Votes {
+		next.Votes[key] = make(map[string]bool)
+		for voter := range voters {
+			next.Votes[key][voter] = true
+		}
+	}
+
+	// Votes that would not change the set of signers are ignored, as are
+	// votes that would leave no signer at all
+	if vote == nil || vote.Authorize == next.IsSigner(vote.Signer) || (!vote.Authorize && len(next.Signers) == 1) {
+		return next
+	}
+
+	key := voteKey(vote)
+	if next.Votes[key] == nil {
+		next.Votes[key] = make(map[string]bool)
+	}
+	next.Votes[key][hex.EncodeToString(sealer)] = true
+
+	if len(next.Votes[key]) <= len(next.Signers)/2 {
+		return next
+	}
+
+	// A majority of the signers agreed: apply the proposal and clear its votes
+	delete(next.Votes, voteKey(&SignerVote{vote.Signer, true}))
+	delete(next.Votes, voteKey(&SignerVote{vote.Signer, false}))
+
+	if vote.Authorize {
+		next.Signers = append(next.Signers, vote.Signer)
+		next.sortSigners()
+	} else {
+		var signers [][]byte
+		for _, s := range next.Signers {
+			if bytes.Compare(s, vote.Signer) != 0 {
+				signers = append(signers, s)
+			}
+		}
+		next.Signers = signers
+
+		// The votes of a removed signer no longer count
+		for _, voters := range next.Votes {
+			delete(voters, hex.EncodeToString(vote.Signer))
+		}
+	}
+
+	return next
+}
+
+// Function to serialize the engine data of a block into bytes, using the canonical encoding
+func (extra poaExtra) Serialize() []byte {
+	var e encoder
+	encodePoAExtra(&e, extra)
+
+	return e.buf.Bytes()
+}
+
+// Hash the header of a block along with its version, including the engine data
+// but not the signature
+func poaHash(block *Block) []byte {
+	var e encoder
+	encodeHashedHeader(&e, block)
+	hash := sha256.Sum256(e.buf.Bytes())
+
+	return hash[:]
+}
+
+// Get the snapshot of the signers following the given block, replaying the
+// votes of its ancestors down to the last block with a known snapshot
+func (engine *PoA) snapshot(chain ChainReader, block *Block) (*Snapshot, error) {
+	engine.lock.Lock()
+	defer engine.lock.Unlock()
+
+	if engine.snapshots == nil {
+		engine.snapshots = make(map[string]*Snapshot)
+	}
+
+	var snap *Snapshot
+	var pending []*Block
+
+	for {
+		if cached, ok := engine.snapshots[string(block.Hash)]; ok {
+			snap = cached
+			break
+		}
+
+		extra, err := decodePoAExtra(block.Extra)
+		if err != nil {
+			return nil, ErrInvalidSeal
+		}
+
+		if len(block.PrevHash) == 0 {
+			snap = newSnapshot(extra.Signers)
+			engine.snapshots[string(block.Hash)] = snap
+			break
+		}
+
+		pending = append(pending, block)
+		block, err = chain.GetBlock(block.PrevHash)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for i := len(pending) - 1; i >= 0; i-- {
+		extra, _ := decodePoAExtra(pending[i].Extra)
+		snap = snap.apply(extra.Sealer, extra.Vote)
+		engine.snapshots[string(pending[i].Hash)] = snap
+	}
+
+	return snap, nil
+}
+
+// Get the snapshot of the signers allowed to seal the given block
+func (engine *PoA) parentSnapshot(chain ChainReader, block *Block) (*Snapshot, error) {
+	parent, err := chain.GetBlock(block.PrevHash)
+	if err != nil {
+		return nil, err
+	}
+
+	return engine.snapshot(chain, parent)
+}
+
+// Get the snapshot of the signers following the block with the given hash
+func (engine *PoA) Snapshot(chain ChainReader, hash []byte) (*Snapshot, error) {
+	block, err := chain.GetBlock(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	return engine.snapshot(chain, block)
+}
+
+func (engine *PoA) Name() string {
+	return "poa"
+}
+
+// All PoA blocks have the same difficulty, since sealing them takes no work
+func (engine *PoA) Difficulty(chain ChainReader, parent *Block) (int, error) {
+	return 1, nil
+}
+
+// Sign the block with the key of the signer in turn, which must be held by a
+// local wallet, adding the vote for one of the pending proposals of this node
+func (engine *PoA) Seal(ctx context.Context, chain ChainReader, block *Block) error {
+	var snap *Snapshot
+	var extra poaExtra
+
+	if len(block.PrevHash) == 0 {
+		snap = newSnapshot(engine.Signers)
+		extra.Signers = snap.Signers
+	} else {
+		var err error
+		snap, err = engine.parentSnapshot(chain, block)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(snap.Signers) == 0 {
+		return ErrUnauthorizedSigner
+	}
+
+	extra.Sealer = snap.InTurn(block.Height)
+	privKey, err := signerKey(engine.WalletDir, extra.Sealer)
+	if err != nil {
+		return err
+	}
+
+	if len(block.PrevHash) != 0 {
+		extra.Vote, err = engine.pendingVote(snap, extra.Sealer)
+		if err != nil {
+			return err
+		}
+	}
+
+	block.Extra = extra.Serialize()
+	block.Hash = poaHash(block)
+
+	r, s, err := ecdsa.Sign(rand.Reader, &privKey, block.Hash)
+	if err != nil {
+		return err
+	}
+
+	// Pad r and s to the size of the curve, so that the signature splits evenly
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	block.Signature = signature
+
+	return nil
+}
+
+// The block must be signed by the authorized signer in turn at its height.
+// PoA blocks carry no nonce, since it is not covered by the signature.
+func (engine *PoA) Verify(chain ChainReader, block *Block) error {
+	extra, err := decodePoAExtra(block.Extra)
+	if err != nil || block.Nonce != 0 || bytes.Compare(block.Hash, poaHash(block)) != 0 {
+		return ErrInvalidSeal
+	}
+
+	var snap *Snapshot
+	if len(block.PrevHash) == 0 {
+		if len(extra.Signers) == 0 || extra.Vote != nil {
+			return ErrInvalidSeal
+		}
+		snap = newSnapshot(extra.Signers)
+	} else {
+		if len(extra.Signers) != 0 {
+			return ErrInvalidSeal
+		}
+		snap, err = engine.parentSnapshot(chain, block)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !snap.IsSigner(extra.Sealer) {
+		return ErrUnauthorizedSigner
+	}
+	if bytes.Compare(snap.InTurn(block.Height), extra.Sealer) != 0 {
+		return ErrOutOfTurnSigner
+	}
+
+	if len(block.Signature) != 64 || len(extra.Sealer) == 0 {
+		return ErrInvalidSeal
+	}
+
+	r := new(big.Int).SetBytes(block.Signature[:32])
+	s := new(big.Int).SetBytes(block.Signature[32:])
+
+	keyLen := len(extra.Sealer)
+	x := new(big.Int).SetBytes(extra.Sealer[:(keyLen / 2)])
+	y := new(big.Int).SetBytes(extra.Sealer[(keyLen / 2):])
+	pubKey := ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+
+	if !ecdsa.Verify(&pubKey, block.Hash, r, s) {
+		return ErrInvalidSeal
+	}
+
+	return nil
+}
+
+// Every block counts the same towards the weight of a PoA chain
+func (engine *PoA) Work(block *Block) *big.Int {
+	return big.NewInt(int64(block.Difficulty))
+}
+
+// Find the private key of a signer among the local wallets
+func signerKey(walletDir string, signer []byte) (ecdsa.PrivateKey, error) {
+	wallets, err := wallet.CreateWallets(walletDir)
+	if err != nil {
+		return ecdsa.PrivateKey{}, ErrNoSignerKey
+	}
+
+	for _, w := range wallets.Wallets {
+		if bytes.Compare(w.PublicKey, signer) == 0 {
+			return w.PrivateKey, nil
+		}
+	}
+
+	return ecdsa.PrivateKey{}, ErrNoSignerKey
+}
+
+// Record a proposal of this node to add or remove a signer. The signers of this
+// node vote for it in the blocks they seal until it gets applied or discarded.
+func (engine *PoA) Propose(signer []byte, authorize bool) error {
+	value := []byte{0}
+	if authorize {
+		value[0] = 1
+	}
+
+	return engine.Database.Update(func(txn *badger.Txn) error {
+		return txn.Set(append(append([]byte{}, proposalPrefix...), signer...), value)
+	})
+}
+
+// Discard a proposal of this node
+func (engine *PoA) Discard(signer []byte) error {
+	return engine.Database.Update(func(txn *badger.Txn) error {
+		return txn.Delete(append(append([]byte{}, proposalPrefix...), signer...))
+	})
+}
+
+// Get the pending proposals of this node
+func (engine *PoA) Proposals() ([]SignerVote, error) {
+	var proposals []SignerVote
+
+	if engine.Database == nil {
+		return proposals, nil
+	}
+
+	err := engine.Database.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek(proposalPrefix); it.ValidForPrefix(proposalPrefix); it.Next() {
+			value, err := it.Item().Value()
+			if err != nil {
+				return err
+			}
+			signer := it.Item().KeyCopy(nil)[len(proposalPrefix):]
+			proposals = append(proposals, SignerVote{signer, value[0] == 1})
+		}
+
+		return nil
+	})
+
+	return proposals, err
+}
+
+// Choose the vote a signer casts in the block it seals: the first pending
+// proposal that would change the set of signers and it has not voted for yet
+func (engine *PoA) pendingVote(snap *Snapshot, sealer []byte) (*SignerVote, error) {
+	proposals, err := engine.Proposals()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, proposal := range proposals {
+		vote := proposal
+		if vote.Authorize != snap.IsSigner(vote.Signer) && !snap.Votes[voteKey(&vote)][hex.EncodeToString(sealer)] {
+			return &vote, nil
+		}
+	}
+
+	return nil, nil
+}
@@ -2,89 +2,316 @@ package blockchain
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/binary"
-	"fmt"
-	"log"
+	"errors"
 	"math"
 	"math/big"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// Statically set difficulty for PoW mining
-const Difficulty = 18
-
 // Proof of Work Structure
 type ProofOfWork struct {
-	Block  *Block
-	Target *big.Int
+	Block    *Block
+	Target   *big.Int
+	Workers  int                // Number of goroutines searching for a nonce
+	Progress func(MiningStatus) // Called periodically while mining, if set
 }
 
-// Initialize a proof for a block using the target difficulty of the hash to be found
+// Initialize a proof for a block using the target difficulty of the hash to be found,
+// as set in the block itself. A difficulty outside of the valid range gets a
+// zero target, which no hash meets.
 func NewProof(b *Block) *ProofOfWork {
-	target := big.NewInt(1)
-	target.Lsh(target, uint(256-Difficulty))
-	pow := &ProofOfWork{b, target}
+	target := new(big.Int)
+	if b.Difficulty >= minDifficulty && b.Difficulty <= maxDifficulty {
+		target.Lsh(big.NewInt(1), uint(256-b.Difficulty))
+	}
+	pow := &ProofOfWork{b, target, MiningWorkers, MiningProgress}
 
 	return pow
 }
 
-// Initialize the data of the block in a PoW proof. Convert all individual
-// parameters to bytes and concatenate them.
+// Initialize the data of the block in a PoW proof, which is the encoding of its
+// header along with its version (see encodeHashedHeader), using the given
+// nonce. Legacy blocks only cover the previous hash, the transactions, the
+// nonce and the difficulty, converted to bytes and concatenated.
 func (pow *ProofOfWork) InitData(nonce int) []byte {
-	data := bytes.Join(
-		[][]byte{
-			pow.Block.PrevHash,
-			pow.Block.HashTransactions(),
-			ToHex(int64(nonce)),
-			ToHex(int64(Difficulty)),
-		},
-		[]byte{},
-	)
-	return data
+	prefix, suffix := pow.splitData()
+	data := pow.appendNonce(prefix, nonce)
+
+	return append(data, suffix...)
+}
+
+// Split the data of the block around its nonce, which is all that changes
+// between two attempts
+func (pow *ProofOfWork) splitData() ([]byte, []byte) {
+	if pow.Block.Version == LegacyBlockVersion {
+		prefix := bytes.Join([][]byte{pow.Block.PrevHash, pow.Block.HashTransactions()}, []byte{})
+		return prefix, ToHex(int64(pow.Block.Difficulty))
+	}
+
+	var prefix, suffix encoder
+	prefix.uvarint(uint64(pow.Block.Version))
+	encodeHeaderPrefix(&prefix, pow.Block)
+
+	// The rest of the header after the nonce: the engine data and an empty signature
+	suffix.bytes(pow.Block.Extra)
+	suffix.bytes(nil)
+
+	return prefix.buf.Bytes(), suffix.buf.Bytes()
+}
+
+// Append the nonce to the data of the block as it is encoded in the version of the block
+func (pow *ProofOfWork) appendNonce(data []byte, nonce int) []byte {
+	var buf [binary.MaxVarintLen64]byte
+
+	if pow.Block.Version == LegacyBlockVersion {
+		binary.BigEndian.PutUint64(buf[:], uint64(nonce))
+		return append(data, buf[:8]...)
+	}
+
+	return append(data, buf[:binary.PutVarint(buf[:], int64(nonce))]...)
 }
 
 // Convert an integer to bytes (using Big Endian form)
 func ToHex(num int64) []byte {
-	buff := new(bytes.Buffer)
-	err := binary.Write(buff, binary.BigEndian, num)
-	if err != nil {
-		log.Panic(err)
-	}
+	buff := make([]byte, 8)
+	binary.BigEndian.PutUint64(buff, uint64(num))
+
+	return buff
+}
 
-	return buff.Bytes()
+// Status of a running PoW, reported periodically to the progress callback
+type MiningStatus struct {
+	Hashes   uint64        // Number of hashes computed so far
+	Elapsed  time.Duration // Time spent mining so far
+	Hashrate float64       // Hashes computed per second
 }
 
+// Default settings used for every new proof
+var (
+	MiningWorkers    = runtime.NumCPU() // Number of goroutines searching for a nonce
+	MiningProgress   func(MiningStatus) // Called periodically while mining, if set
+	ProgressInterval = time.Second      // Time between two calls of the progress callback
+)
+
+// Number of hashes a worker computes between two checks of whether the search is over
+const hashBatch = 1 << 10
+
 // Run the PoW algorithm to find the appropriate nonce value for the block
 func (pow *ProofOfWork) Run() (int, []byte) {
-	var intHash big.Int
-	var hash [32]byte
+	// The background context is never cancelled, so the search always succeeds
+	nonce, hash, _ := pow.RunContext(context.Background())
+
+	return nonce, hash
+}
+
+// Run the PoW algorithm until a nonce is found or the context is cancelled, in
+// which case the error of the context is returned. The nonce space is split
+// between the workers, worker i trying the nonces i, i + workers,
+// i + 2*workers, ..., and all of them stop on the first solution.
+func (pow *ProofOfWork) RunContext(ctx context.Context) (int, []byte, error) {
+	workers := pow.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	type solution struct {
+		nonce int
+		hash  []byte
+	}
 
-	nonce := 0
-	for nonce < math.MaxInt64 {
-		data := pow.InitData(nonce)
-		hash = sha256.Sum256(data)
+	var hashes uint64
+	var found int32
+	solutions := make(chan solution, workers)
+	var wg sync.WaitGroup
 
-		fmt.Printf("\r%x", hash)
+	start := time.Now()
 
-		intHash.SetBytes(hash[:])
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(first int) {
+			defer wg.Done()
+
+			// Only the nonce changes, so the data around it is encoded once
+			prefix, suffix := pow.splitData()
+			data := make([]byte, 0, len(prefix)+binary.MaxVarintLen64+len(suffix))
+			data = append(data, prefix...)
+			var intHash big.Int
+
+			count := 0
+			for nonce := first; nonce >= 0 && nonce < math.MaxInt64; nonce += workers {
+				data = append(pow.appendNonce(data[:len(prefix)], nonce), suffix...)
+				hash := sha256.Sum256(data)
+				intHash.SetBytes(hash[:])
+
+				if intHash.Cmp(pow.Target) == -1 {
+					if atomic.CompareAndSwapInt32(&found, 0, 1) {
+						solutions <- solution{nonce, hash[:]}
+					}
+					return
+				}
+
+				if count++; count == hashBatch {
+					count = 0
+					atomic.AddUint64(&hashes, hashBatch)
+					if atomic.LoadInt32(&found) != 0 || ctx.Err() != nil {
+						return
+					}
+				}
+			}
+		}(w)
+	}
+
+	// Close the channel of solutions once all the workers have given up
+	go func() {
+		wg.Wait()
+		close(solutions)
+	}()
+
+	// Report the progress of the workers until a solution is found
+	done := make(chan struct{})
+	var reporter sync.WaitGroup
+	if pow.Progress != nil {
+		reporter.Add(1)
+		go func() {
+			defer reporter.Done()
+			ticker := time.NewTicker(ProgressInterval)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					pow.Progress(miningStatus(atomic.LoadUint64(&hashes), start))
+				}
+			}
+		}()
+	}
 
-		if intHash.Cmp(pow.Target) == -1 {
-			break
-		} else {
-			nonce++
+	var sol solution
+	var err error
+
+	select {
+	case s, ok := <-solutions:
+		sol = s
+		if !ok {
+			err = errors.New("No nonce satisfies the target")
 		}
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	// Stop the workers and the progress reporter before returning
+	atomic.StoreInt32(&found, 1)
+	close(done)
+	wg.Wait()
+	reporter.Wait()
+
+	if err != nil {
+		return 0, nil, err
 	}
-	fmt.Println()
 
-	return nonce, hash[:]
+	if pow.Progress != nil {
+		pow.Progress(miningStatus(atomic.LoadUint64(&hashes), start))
+	}
+
+	return sol.nonce, sol.hash, nil
+}
+
+// Compute the status of a PoW from the number of hashes computed since it started
+func miningStatus(hashes uint64, start time.Time) MiningStatus {
+	elapsed := time.Since(start)
+
+	return MiningStatus{hashes, elapsed, float64(hashes) / elapsed.Seconds()}
 }
 
-// Check correctness of the hash generated for a block using PoW
+// Check correctness of the hash generated for a block using PoW: the hash
+// stored in the block must be the hash of its data and must meet the target
 func (pow *ProofOfWork) Validate() bool {
 	var intHash big.Int
 	data := pow.InitData(pow.Block.Nonce)
 	hash := sha256.Sum256(data)
 	intHash.SetBytes(hash[:])
 
-	return intHash.Cmp(pow.Target) == -1
+	return intHash.Cmp(pow.Target) == -1 && bytes.Compare(hash[:], pow.Block.Hash) == 0
+}
+
+// Consensus engine sealing blocks with SHA-256 Proof of Work
+type PoW struct {
+	Workers           int                // Number of goroutines searching for a nonce
+	Progress          func(MiningStatus) // Called periodically while mining, if set
+	InitialDifficulty int                // Difficulty of the genesis block
+	RetargetInterval  int                // Number of blocks between two changes of the difficulty (0 never changes it)
+	TargetBlockTime   int                // Desired number of seconds between two consecutive blocks
+}
+
+// Create a PoW engine using the default mining settings and InitialDifficulty,
+// which never changes
+func NewPoW() *PoW {
+	return &PoW{MiningWorkers, MiningProgress, InitialDifficulty, 0, 0}
+}
+
+// Create a PoW engine using the default mining settings, for a chain with the
+// given parameters
+func NewChainPoW(params ChainParams) *PoW {
+	engine := NewPoW()
+	engine.InitialDifficulty = params.Difficulty
+	engine.RetargetInterval = params.RetargetInterval
+	engine.TargetBlockTime = params.TargetBlockTime
+
+	return engine
+}
+
+func (engine *PoW) Name() string {
+	return "pow"
+}
+
+// The difficulty starts at the initial difficulty of the engine and is retargeted every RetargetInterval blocks
+func (engine *PoW) Difficulty(chain ChainReader, parent *Block) (int, error) {
+	if parent == nil {
+		return engine.InitialDifficulty, nil
+	}
+
+	return nextDifficulty(chain, parent, engine.RetargetInterval, engine.TargetBlockTime)
+}
+
+// Find a nonce giving the block a hash that meets the target of its difficulty
+func (engine *PoW) Seal(ctx context.Context, chain ChainReader, block *Block) error {
+	pow := NewProof(block)
+	pow.Workers = engine.Workers
+	pow.Progress = engine.Progress
+
+	nonce, hash, err := pow.RunContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	block.Hash = hash
+	block.Nonce = nonce
+	return nil
+}
+
+// The hash of the block must meet its target, given by a difficulty within the
+// valid range. PoW blocks carry no engine data nor signature, since those are
+// not covered by the hash.
+func (engine *PoW) Verify(chain ChainReader, block *Block) error {
+	if block.Difficulty < minDifficulty || block.Difficulty > maxDifficulty {
+		return ErrInvalidPoW
+	}
+	if len(block.Extra) != 0 || len(block.Signature) != 0 || !NewProof(block).Validate() {
+		return ErrInvalidPoW
+	}
+
+	return nil
+}
+
+// Each unit of difficulty doubles the expected number of hashes needed for a block
+func (engine *PoW) Work(block *Block) *big.Int {
+	return new(big.Int).Lsh(big.NewInt(1), uint(block.Difficulty))
 }
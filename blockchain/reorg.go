@@ -0,0 +1,314 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+	"time"
+
+	"github.com/dgraph-io/badger"
+)
+
+// Deepest reorganization of the chain: side blocks forking more than
+// MaxReorgDepth blocks below the last block, or extending a side chain beyond
+// MaxReorgDepth blocks, are rejected with ErrReorgTooDeep. A reorganization
+// runs within a single database transaction so that the chain never ends up
+// half reorganized; one whose blocks carry too many transactions for a single
+// database transaction is rejected with ErrReorgTooDeep as well, leaving the
+// chain as it was.
+var MaxReorgDepth = 100
+
+// Error returned for side blocks the chain would not reorganize onto
+var ErrReorgTooDeep = errors.New("side chain is too deep to reorganize onto")
+
+// Prefix of the keys under which the cumulative work of every stored block is
+// kept in the database: the total work of the chain from the genesis block up
+// to and including the block, as given by the consensus engine
+var workPrefix = []byte("work-")
+
+// Create the database key of the cumulative work of a block using its hash
+func workKey(hash []byte) []byte {
+	return append(append([]byte{}, workPrefix...), hash...)
+}
+
+// Get the cumulative work of the chain ending with a block within a database
+// transaction. Blocks stored before the work was recorded get theirs from the
+// work of their ancestors.
+func (chain *Blockchain) chainWork(txn *badger.Txn, block *Block) (*big.Int, error) {
+	work := new(big.Int)
+
+	for {
+		item, err := txn.Get(workKey(block.Hash))
+		if err == nil {
+			recorded, err := item.Value()
+			if err != nil {
+				return nil, err
+			}
+			return work.Add(work, new(big.Int).SetBytes(recorded)), nil
+		} else if err != badger.ErrKeyNotFound {
+			return nil, err
+		}
+
+		work.Add(work, chain.Engine.Work(block))
+		if len(block.PrevHash) == 0 {
+			return work, nil
+		}
+
+		block, err = getBlock(txn, block.PrevHash)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Get the cumulative work of the chain ending with the block of the given hash
+func (chain *Blockchain) ChainWork(hash []byte) (*big.Int, error) {
+	var work *big.Int
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		block, err := getBlock(txn, hash)
+		if err != nil {
+			return err
+		}
+
+		work, err = chain.chainWork(txn, block)
+		return err
+	})
+
+	return work, err
+}
+
+// Check within a database transaction whether a block is part of the main
+// chain, which the height index only ever points to
+func inMainChain(txn *badger.Txn, block *Block) (bool, error) {
+	item, err := txn.Get(heightIndexKey(block.Height))
+	if err == badger.ErrKeyNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	hash, err := item.Value()
+	if err != nil {
+		return false, err
+	}
+
+	return bytes.Equal(hash, block.Hash), nil
+}
+
+// Check whether the block of the given hash is part of the main chain, rather than of a side chain
+func (chain *Blockchain) InMainChain(hash []byte) (bool, error) {
+	var main bool
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		block, err := getBlock(txn, hash)
+		if err != nil {
+			return err
+		}
+
+		main, err = inMainChain(txn, block)
+		return err
+	})
+
+	return main, err
+}
+
+// Store a block that does not build on the last block within a database
+// transaction, once its header is checked against its parent, and reorganize
+// the chain onto it if its chain now has more cumulative work than the main
+// chain (the first chain seen wins a tie). Return the hash of the last block.
+func (chain *Blockchain) acceptSideBlock(txn *badger.Txn, lastBlock, block *Block) ([]byte, error) {
+	if len(block.PrevHash) == 0 {
+		return nil, &ValidationError{block.Hash, nil, ErrUnknownParent}
+	}
+	parent, err := getBlock(txn, block.PrevHash)
+	if err == ErrBlockNotFound {
+		return nil, &ValidationError{block.Hash, nil, ErrUnknownParent}
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := chain.validateHeader(txn, block, parent); err != nil {
+		return nil, err
+	}
+	if err := checkUnknownBlock(txn, block); err != nil {
+		return nil, err
+	}
+
+	fork, branch, err := sideBranch(txn, block)
+	if err != nil {
+		return nil, err
+	}
+	if lastBlock.Height-fork.Height > MaxReorgDepth || len(branch) > MaxReorgDepth {
+		return nil, &ValidationError{block.Hash, nil, ErrReorgTooDeep}
+	}
+
+	work, err := chain.chainWork(txn, parent)
+	if err != nil {
+		return nil, err
+	}
+	work.Add(work, chain.Engine.Work(block))
+	if err := storeBlock(txn, block, work); err != nil {
+		return nil, err
+	}
+
+	lastWork, err := chain.chainWork(txn, lastBlock)
+	if err != nil {
+		return nil, err
+	}
+	if work.Cmp(lastWork) <= 0 {
+		return lastBlock.Hash, nil
+	}
+
+	err = chain.reorganize(txn, lastBlock, fork, branch)
+	if errors.Is(err, badger.ErrTxnTooBig) {
+		return nil, &ValidationError{block.Hash, nil, ErrReorgTooDeep}
+	} else if err != nil {
+		return nil, err
+	}
+
+	return block.Hash, nil
+}
+
+// Walk a side chain within a database transaction from the given block back to
+// the main chain, returning the block of the main chain it forks from and the
+// blocks of the side chain from the given one
+func sideBranch(txn *badger.Txn, block *Block) (*Block, []*Block, error) {
+	var branch []*Block
+
+	for {
+		main, err := inMainChain(txn, block)
+		if err != nil {
+			return nil, nil, err
+		}
+		if main {
+			return block, branch, nil
+		}
+
+		branch = append(branch, block)
+		block, err = getBlock(txn, block.PrevHash)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+// Reorganize the chain within a database transaction so that it ends with the
+// given branch of a side chain (from its last block, as found by sideBranch):
+// the blocks of the main chain are disconnected down to the fork, and the
+// blocks of the side chain are then validated and connected. The transactions
+// of the disconnected blocks return to the mempool, which is then cleared of
+// the transactions no longer valid. Nothing is changed if any block of the
+// side chain is invalid.
+func (chain *Blockchain) reorganize(txn *badger.Txn, lastBlock, fork *Block, branch []*Block) error {
+	for block := lastBlock; !bytes.Equal(block.Hash, fork.Hash); {
+		if err := disconnectBlock(txn, block); err != nil {
+			return err
+		}
+
+		var err error
+		block, err = getBlock(txn, block.PrevHash)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := len(branch) - 1; i >= 0; i-- {
+		if err := chain.validateBlockTransactions(txn, branch[i]); err != nil {
+			return err
+		}
+		if err := connectBlock(txn, branch[i]); err != nil {
+			return err
+		}
+	}
+
+	return chain.revalidateMempool(txn, branch[0].Height+1)
+}
+
+// Undo connectBlock for the last block of the chain within a database
+// transaction: remove the outputs its transactions created from the UTXO set
+// and restore those they spent, remove them from the indexes, return them to
+// the mempool (except the coinbase) and make the parent the last block
+func disconnectBlock(txn *badger.Txn, block *Block) error {
+	now := time.Now().Unix()
+
+	// Go through the transactions backwards, so that an output created and
+	// spent within the block is restored by the transaction spending it and
+	// then removed by the one creating it
+	for i := len(block.Transactions) - 1; i >= 0; i-- {
+		tx := block.Transactions[i]
+
+		for outIdx := range tx.Outputs {
+			if err := txn.Delete(utxoKey(tx.ID, outIdx)); err != nil {
+				return err
+			}
+		}
+
+		if !tx.IsCoinbase() {
+			inputSum := 0
+
+			for _, in := range tx.Inputs {
+				prevTx, prevBlock, err := findTransactionBlock(txn, in.ID)
+				if err != nil {
+					return err
+				}
+				if in.Out < 0 || in.Out >= len(prevTx.Outputs) {
+					return &CorruptionError{block.Hash, block.Height, tx.ID, ErrInvalidOutput}
+				}
+
+				utxo := UTXO{prevTx.ID, in.Out, prevTx.Outputs[in.Out], prevBlock.Height, prevTx.IsCoinbase()}
+				if err := txn.Set(utxoKey(utxo.TxID, utxo.Out), utxo.Serialize()); err != nil {
+					return err
+				}
+				inputSum += utxo.Output.Value
+			}
+
+			outputSum := 0
+			for _, out := range tx.Outputs {
+				outputSum += out.Value
+			}
+
+			entry := MempoolEntry{*tx, inputSum - outputSum, tx.Size(), now}
+			if err := putMempoolEntry(txn, entry); err != nil {
+				return err
+			}
+		}
+
+		if err := txn.Delete(txIndexKey(tx.ID)); err != nil {
+			return err
+		}
+	}
+
+	if err := txn.Delete(heightIndexKey(block.Height)); err != nil {
+		return err
+	}
+
+	return swapLastHash(txn, block.Hash, block.PrevHash)
+}
+
+// Remove from the mempool within a database transaction the transactions that
+// are no longer valid in the block at the given height, such as those
+// spending outputs of disconnected blocks or of other pending transactions
+func (chain *Blockchain) revalidateMempool(txn *badger.Txn, height int) error {
+	entries, err := mempoolEntries(txn)
+	if err != nil {
+		return err
+	}
+
+	spent := make(map[string]bool)
+	seen := make(map[string]Transaction)
+
+	for i := range entries {
+		entry := entries[i]
+
+		_, err := chain.validateTransaction(txn, height, &entry.Tx, spent, seen)
+		if _, invalid := err.(*ValidationError); invalid {
+			if err := deleteMempoolEntry(txn, entry); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,69 @@
+package blockchain
+
+import (
+	"math"
+)
+
+// Subsidy given by the schedule at a height, before the maximum supply is
+// applied: it starts at the Subsidy of the chain and is halved every HalvingInterval blocks
+func (p ChainParams) scheduledSubsidy(height int) int {
+	halvings := height / p.HalvingInterval
+	if halvings >= 63 {
+		return 0
+	}
+
+	return p.Subsidy >> uint(halvings)
+}
+
+// Number of tokens issued by the blocks below the given height, including the
+// initial balances allocated by the genesis block. No more than MaxSupply
+// tokens are ever issued.
+func (p ChainParams) Supply(height int) int {
+	if height <= 0 {
+		return 0
+	}
+
+	supply := p.allocated()
+
+	// Add up the subsidies era by era, an era being the blocks between two halvings
+	for start := 0; start < height; start += p.HalvingInterval {
+		subsidy := p.scheduledSubsidy(start)
+		if subsidy == 0 {
+			break
+		}
+
+		blocks := p.HalvingInterval
+		if height-start < blocks {
+			blocks = height - start
+		}
+		supply += blocks * subsidy
+
+		if supply >= p.MaxSupply {
+			break
+		}
+	}
+
+	if supply >= p.MaxSupply {
+		return p.MaxSupply
+	}
+
+	return supply
+}
+
+// Number of tokens that will ever be issued
+func (p ChainParams) TotalSupply() int {
+	return p.Supply(math.MaxInt64)
+}
+
+// Number of new tokens the coinbase of the block at a height may claim,
+// besides the fees of the other transactions of the block (for the genesis
+// block, this includes the initial balances)
+func (p ChainParams) BlockSubsidy(height int) int {
+	return p.Supply(height+1) - p.Supply(height)
+}
+
+// Check that a value, or a sum of values, is an amount of tokens that can
+// exist on the chain: neither negative nor above the maximum supply
+func (p ChainParams) moneyRange(value int) bool {
+	return value >= 0 && value <= p.MaxSupply
+}
@@ -0,0 +1,90 @@
+package blockchain
+
+import (
+	"context"
+
+	"github.com/dgraph-io/badger"
+)
+
+// Build an unsealed block with the given transactions on top of the last block,
+// checking them before any work is spent on sealing the block
+func (chain *Blockchain) NewBlockTemplate(transactions []*Transaction) (*Block, error) {
+	var block *Block
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		lastBlock, err := getLastBlock(txn)
+		if err != nil {
+			return err
+		}
+
+		block, err = chain.newBlockTemplate(txn, lastBlock, transactions)
+		return err
+	})
+
+	return block, err
+}
+
+// Build an unsealed block with the given transactions on top of the given
+// block within a database transaction
+func (chain *Blockchain) newBlockTemplate(txn *badger.Txn, lastBlock *Block, transactions []*Transaction) (*Block, error) {
+	difficulty, err := chain.Engine.Difficulty(txnReader{txn}, lastBlock)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := chain.validateTransactions(txn, lastBlock.Height+1, transactions); err != nil {
+		return nil, err
+	}
+
+	// A block may share the timestamp of its parent, but never go back in time
+	// when the local clock is behind the timestamp of the parent
+	block := NewBlock(transactions, lastBlock.Hash, lastBlock.Height+1, difficulty)
+	if block.Timestamp < lastBlock.Timestamp {
+		block.Timestamp = lastBlock.Timestamp
+	}
+
+	return block, nil
+}
+
+// Build an unsealed block with the pending transactions of the mempool, by
+// decreasing fee rate, and a coinbase paying the subsidy and fees to the address
+func (chain *Blockchain) MempoolTemplate(address string) (*Block, error) {
+	var block *Block
+
+	// Read the mempool and the last block from the same snapshot of the
+	// database, so that the coinbase matches the height of the block
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		lastBlock, err := getLastBlock(txn)
+		if err != nil {
+			return err
+		}
+
+		txs, fees, err := chain.selectMempool(txn, lastBlock.Height+1, MaxBlockBytes)
+		if err != nil {
+			return err
+		}
+
+		subsidy := chain.Params.BlockSubsidy(lastBlock.Height + 1)
+		cbTx, err := CoinbaseTx(address, "", subsidy+fees)
+		if err != nil {
+			return err
+		}
+
+		block, err = chain.newBlockTemplate(txn, lastBlock, append([]*Transaction{cbTx}, txs...))
+		return err
+	})
+
+	return block, err
+}
+
+// Seal a block template with the consensus engine and add it on top of the
+// blockchain, giving up with the error of the context if it is cancelled while
+// sealing. If another block was added in the meantime, the sealed block is
+// dropped rather than stored on a side chain, failing with ErrPrevHashMismatch.
+func (chain *Blockchain) MineBlock(ctx context.Context, block *Block) error {
+	if err := chain.Engine.Seal(ctx, chain, block); err != nil {
+		return err
+	}
+
+	return chain.addBlock(block, true)
+}
@@ -8,24 +8,32 @@ import (
 	"crypto/sha256"
 	"encoding/gob"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
 	"math/big"
 	"strings"
 
 	"github.com/tezansahu/golang_blockchain/wallet"
 )
 
-// Function to serialize the transaction structure into bytes
+// Function to serialize the transaction structure into bytes, using the canonical encoding
 func (txn *Transaction) Serialize() []byte {
-	var res bytes.Buffer
-	encoder := gob.NewEncoder(&res)
+	var e encoder
+	encodeTransaction(&e, txn)
 
-	err := encoder.Encode(txn)
+	return e.buf.Bytes()
+}
 
-	Handle(err)
+// Function to deserialize a transaction from bytes, returning an error if the data is not in the canonical encoding
+func DeserializeTransaction(data []byte) (*Transaction, error) {
+	d := &decoder{data: data}
+	tx := decodeTransaction(d)
 
-	return res.Bytes()
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+
+	return tx, nil
 }
 
 // Hash the data within a transaction after serializing it
@@ -35,11 +43,65 @@ func (txn *Transaction) Hash() []byte {
 	txCopy := *txn
 	txCopy.ID = []byte{}
 
+	if txn.Version == LegacyTxVersion {
+		return legacyHash(&txCopy)
+	}
+
 	hash = sha256.Sum256(txCopy.Serialize())
 
 	return hash[:]
 }
 
+// Hash a transaction the way transactions were hashed before the canonical
+// encoding existed, by gob encoding it. The types have the names and fields
+// that gob recorded at the time, so that the encoding comes out the same.
+func legacyHash(txn *Transaction) []byte {
+	type TxOutput struct {
+		Value      int
+		PubKeyHash []byte
+	}
+	type TxInput struct {
+		ID        []byte
+		Out       int
+		Signature []byte
+		PubKey    []byte
+	}
+	type Transaction struct {
+		ID      []byte
+		Inputs  []TxInput
+		Outputs []TxOutput
+	}
+
+	legacy := Transaction{ID: txn.ID}
+	for _, in := range txn.Inputs {
+		legacy.Inputs = append(legacy.Inputs, TxInput{in.ID, in.Out, in.Signature, in.PubKey})
+	}
+	for _, out := range txn.Outputs {
+		legacy.Outputs = append(legacy.Outputs, TxOutput{out.Value, out.PubKeyHash})
+	}
+
+	// Encoding these types into a buffer never fails
+	var res bytes.Buffer
+	gob.NewEncoder(&res).Encode(legacy)
+
+	hash := sha256.Sum256(res.Bytes())
+
+	return hash[:]
+}
+
+// Hash the data within a transaction without the signatures of its inputs. Since
+// transactions get their ID before being signed, this is what the ID must match.
+func (txn *Transaction) UnsignedHash() []byte {
+	txCopy := *txn
+	txCopy.Inputs = make([]TxInput, len(txn.Inputs))
+
+	for i, in := range txn.Inputs {
+		txCopy.Inputs[i] = TxInput{in.ID, in.Out, nil, in.PubKey}
+	}
+
+	return txCopy.Hash()
+}
+
 // func (tx *Transaction) SetID() {
 // 	var hash [32]byte
 // 	var encoded bytes.Buffer
@@ -53,19 +115,29 @@ func (txn *Transaction) Hash() []byte {
 // 	tx.ID = hash[:]
 // }
 
-// Create a Coinbase Transaction for user creating the blockchain
-func CoinbaseTx(to, data string) *Transaction {
+// Create a Coinbase Transaction rewarding the given user with the given value,
+// which is the subsidy of the block plus the fees of its other transactions
+func CoinbaseTx(to, data string, value int) (*Transaction, error) {
+	// Use random data by default, so that two coinbase transactions
+	// to the same user never end up with the same ID
 	if data == "" {
-		data = fmt.Sprintf("Coins to %s", to)
+		randData := make([]byte, 24)
+		if _, err := rand.Read(randData); err != nil {
+			return nil, err
+		}
+		data = fmt.Sprintf("Coins to %s (%x)", to, randData)
 	}
 
 	txInput := TxInput{[]byte{}, -1, nil, []byte(data)}
-	txOutput := NewTXOutput(100, to)
+	txOutput, err := NewTXOutput(value, to)
+	if err != nil {
+		return nil, err
+	}
 
-	txn := Transaction{nil, []TxInput{txInput}, []TxOutput{*txOutput}}
+	txn := Transaction{TxVersion, nil, []TxInput{txInput}, []TxOutput{*txOutput}}
 	txn.ID = txn.Hash()
 
-	return &txn
+	return &txn, nil
 }
 
 // Check is a transaction is a coinbase transaction
@@ -73,52 +145,153 @@ func (tx *Transaction) IsCoinbase() bool {
 	return len(tx.Inputs) == 1 && len(tx.Inputs[0].ID) == 0 && tx.Inputs[0].Out == -1
 }
 
-// Create a new transaction
-func NewTransaction(from, to string, amount int, chain *Blockchain) *Transaction {
+// Error returned when signing an input whose public key has no private key among those given
+var ErrMissingKey = errors.New("no private key for the public key of input")
+
+// Recipient of a payment made by a transaction
+type Recipient struct {
+	Address string `json:"address"` // Address receiving the payment
+	Amount  int    `json:"amount"`  // Number of tokens paid to the address
+}
+
+// Create a new transaction sending an amount to a user and leaving the given
+// fee to the miner of the block that includes it
+func NewTransaction(from, to string, amount, fee int, UTXO *UTXOSet) (*Transaction, error) {
+	return NewPaymentTransaction(from, []Recipient{{to, amount}}, fee, UTXO)
+}
+
+// Create a new transaction paying each recipient with an output of its own,
+// sending the change back to the sender in a single output and leaving the
+// given fee to the miner of the block that includes it
+func NewPaymentTransaction(from string, recipients []Recipient, fee int, UTXO *UTXOSet) (*Transaction, error) {
+	return NewMultiSourceTransaction([]string{from}, recipients, from, fee, nil, UTXO)
+}
+
+// Create a new transaction spending outputs of several wallets of the wallets
+// file, chosen by the coin selector (largest first if nil) to cover the
+// payments and the fee. Each recipient gets an output of its own, and the
+// change is sent to the change address in a single output.
+func NewMultiSourceTransaction(sources []string, recipients []Recipient, change string, fee int, selector CoinSelector, UTXO *UTXOSet) (*Transaction, error) {
 	var inputs []TxInput
 	var outputs []TxOutput
 
-	// Get sending user's data from the wallets
-	wallets, err := wallet.CreateWallets()
-	Handle(err)
-	w := wallets.GetWallet(from)
-	pubKeyHash := wallet.PublicKeyHash(w.PublicKey)
-
-	// Get spendable outputs of the sending user
-	acc, validOutputs := chain.FindSpendableOutputs(pubKeyHash, amount)
+	total := fee
+	for _, r := range recipients {
+		total += r.Amount
+	}
 
-	// Check if enough funds are available for transfer
-	if acc < amount {
-		log.Panic("Error: Funds not enough")
+	wallets, err := wallet.CreateWallets(UTXO.Blockchain.Dir)
+	if err != nil {
+		return nil, err
 	}
 
-	// Use the spendable outputs to create Transaction Inputs for the current transaction
-	for txid, outs := range validOutputs {
-		txID, err := hex.DecodeString(txid)
-		Handle(err)
+	// Wallets of the sources by hex encoded public key hash, to find the owner of each output
+	owners := make(map[string]*wallet.Wallet)
+	var pubKeyHashes [][]byte
+
+	for _, from := range sources {
+		w, err := wallets.GetWallet(from)
+		if err != nil {
+			return nil, err
+		}
 
-		for _, out := range outs {
-			input := TxInput{txID, out, nil, w.PublicKey}
-			inputs = append(inputs, input)
+		pubKeyHash := wallet.PublicKeyHash(w.PublicKey)
+		if _, ok := owners[hex.EncodeToString(pubKeyHash)]; ok {
+			continue
 		}
+		owners[hex.EncodeToString(pubKeyHash)] = &w
+		pubKeyHashes = append(pubKeyHashes, pubKeyHash)
 	}
 
-	// Create Transaction Output transferring the required amount to receiver
-	outputs = append(outputs, *NewTXOutput(amount, to))
+	if selector == nil {
+		selector = LargestFirst{}
+	}
 
-	// Create Transaction Output transferring the excess accumulated amount back to sender
-	if acc > amount {
-		outputs = append(outputs, *NewTXOutput(acc-amount, from))
+	// Choose among the spendable outputs of the sources the ones to spend
+	spendable, err := UTXO.SpendableUTXOs(pubKeyHashes)
+	if err != nil {
+		return nil, err
+	}
+	selected, err := selector.Select(spendable, total)
+	if err != nil {
+		return nil, err
+	}
+
+	// Use the chosen outputs to create Transaction Inputs for the current
+	// transaction, and keep the Private Keys of their owners to sign them
+	keys := make(map[string]ecdsa.PrivateKey)
+	acc := 0
+
+	for _, utxo := range selected {
+		w := owners[hex.EncodeToString(utxo.Output.PubKeyHash)]
+		inputs = append(inputs, TxInput{utxo.TxID, utxo.Out, nil, w.PublicKey})
+		keys[hex.EncodeToString(w.PublicKey)] = w.PrivateKey
+		acc += utxo.Output.Value
+	}
+
+	// Create Transaction Outputs transferring the required amounts to the receivers
+	for _, r := range recipients {
+		out, err := NewTXOutput(r.Amount, r.Address)
+		if err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, *out)
+	}
+
+	// Create Transaction Output transferring the excess accumulated amount to
+	// the change address. Whatever is not claimed by an output is the fee.
+	if acc > total {
+		out, err := NewTXOutput(acc-total, change)
+		if err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, *out)
 	}
 
-	tx := Transaction{nil, inputs, outputs}
+	tx := Transaction{TxVersion, nil, inputs, outputs}
 	tx.ID = tx.Hash()
 
-	// Sign the transaction with sender's Private Key
-	chain.SignTransaction(&tx, w.PrivateKey)
+	// Sign every input with the Private Key of the wallet owning the output it spends
+	if err := UTXO.Blockchain.SignTransactionInputs(&tx, keys); err != nil {
+		return nil, err
+	}
 
-	return &tx
+	return &tx, nil
+}
 
+// Create a new transaction sending an amount to a user and paying a fee of
+// feeRate tokens per kilobyte (1000 bytes) of the signed transaction
+func NewTransactionFeeRate(from, to string, amount, feeRate int, UTXO *UTXOSet) (*Transaction, error) {
+	return NewPaymentTransactionFeeRate(from, []Recipient{{to, amount}}, feeRate, UTXO)
+}
+
+// Create a new transaction paying several recipients like NewPaymentTransaction,
+// with a fee of feeRate tokens per kilobyte of the signed transaction
+func NewPaymentTransactionFeeRate(from string, recipients []Recipient, feeRate int, UTXO *UTXOSet) (*Transaction, error) {
+	return FeeRateTransaction(feeRate, func(fee int) (*Transaction, error) {
+		return NewPaymentTransaction(from, recipients, fee, UTXO)
+	})
+}
+
+// Create a transaction with the given function, paying a fee of feeRate tokens
+// per kilobyte (1000 bytes) of the signed transaction, rounded up. Since the
+// size depends on the inputs needed to cover the fee, the fee is raised until
+// it is enough.
+func FeeRateTransaction(feeRate int, build func(fee int) (*Transaction, error)) (*Transaction, error) {
+	fee := 0
+
+	for {
+		tx, err := build(fee)
+		if err != nil {
+			return nil, err
+		}
+
+		required := (tx.Size()*feeRate + 999) / 1000
+		if fee >= required {
+			return tx, nil
+		}
+		fee = required
+	}
 }
 
 // Function to create a customised copy of a transaction
@@ -135,23 +308,38 @@ func (tx *Transaction) TrimmedCopy() Transaction {
 		outputs = append(outputs, TxOutput{out.Value, out.PubKeyHash})
 	}
 
-	txCopy := Transaction{tx.ID, inputs, outputs}
+	txCopy := Transaction{tx.Version, tx.ID, inputs, outputs}
 
 	return txCopy
 }
 
-// Sign a transaction using user's private key
-func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transaction) {
+// Sign a transaction using user's private key, which must own all of its inputs
+func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transaction) error {
+	keys := make(map[string]ecdsa.PrivateKey)
+	for _, in := range tx.Inputs {
+		keys[hex.EncodeToString(in.PubKey)] = privKey
+	}
+
+	return tx.SignInputs(keys, prevTXs)
+}
+
+// Sign every input of a transaction with the private key matching its public
+// key, taken from the keys indexed by hex encoded public key
+func (tx *Transaction) SignInputs(keys map[string]ecdsa.PrivateKey, prevTXs map[string]Transaction) error {
 
 	// If transaction is a coinbase trnasaction, no need to sign
 	if tx.IsCoinbase() {
-		return
+		return nil
 	}
 
 	// Check if the Transaction Inputs reference valid previous transactions
 	for _, in := range tx.Inputs {
-		if prevTXs[hex.EncodeToString(in.ID)].ID == nil {
-			log.Panic("ERROR: Previous transaction does not exist!")
+		prevTx := prevTXs[hex.EncodeToString(in.ID)]
+		if prevTx.ID == nil {
+			return fmt.Errorf("%w: %x", ErrTxNotFound, in.ID)
+		}
+		if in.Out < 0 || in.Out >= len(prevTx.Outputs) {
+			return fmt.Errorf("%w: %x:%d", ErrMissingInput, in.ID, in.Out)
 		}
 	}
 
@@ -160,6 +348,11 @@ func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transac
 
 	// Iterate through the inputs of the cpoied transaction
 	for inId, in := range txCopy.Inputs {
+		privKey, ok := keys[hex.EncodeToString(tx.Inputs[inId].PubKey)]
+		if !ok {
+			return fmt.Errorf("%w %d", ErrMissingKey, inId)
+		}
+
 		prevTx := prevTXs[hex.EncodeToString(in.ID)]
 		txCopy.Inputs[inId].Signature = nil                            // Double check to see that Signature is nil
 		txCopy.Inputs[inId].PubKey = prevTx.Outputs[in.Out].PubKeyHash // Set the PubKey of input copy as PubKeyHash of referenced output
@@ -168,13 +361,20 @@ func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transac
 
 		// Get the signature on the ID of the transaction copy
 		r, s, err := ecdsa.Sign(rand.Reader, &privKey, txCopy.ID)
-		Handle(err)
+		if err != nil {
+			return err
+		}
 
-		signature := append(r.Bytes(), s.Bytes()...)
+		// Pad r and s to the size of the curve, so that the signature splits evenly
+		signature := make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
 
 		// Set the value of Signatute of the current Transaction Input using the sign obtained
 		tx.Inputs[inId].Signature = signature
 	}
+
+	return nil
 }
 
 // Verify a transaction
@@ -185,10 +385,11 @@ func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
 		return true
 	}
 
-	// Check if the Transaction Inputs reference valid previous transactions
+	// Inputs that do not reference an output of a known previous transaction cannot be valid
 	for _, in := range tx.Inputs {
-		if prevTXs[hex.EncodeToString(in.ID)].ID == nil {
-			log.Panic("ERROR: Previous transaction does not exist!")
+		prevTx := prevTXs[hex.EncodeToString(in.ID)]
+		if prevTx.ID == nil || in.Out < 0 || in.Out >= len(prevTx.Outputs) {
+			return false
 		}
 	}
 
@@ -197,6 +398,12 @@ func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
 
 	for inId, in := range tx.Inputs {
 		prevTx := prevTXs[hex.EncodeToString(in.ID)]
+
+		// The Public Key of the input must be the one locking the referenced output
+		if !in.UsesKey(prevTx.Outputs[in.Out].PubKeyHash) {
+			return false
+		}
+
 		txCopy.Inputs[inId].Signature = nil
 		txCopy.Inputs[inId].PubKey = prevTx.Outputs[in.Out].PubKeyHash
 		txCopy.ID = txCopy.Hash()
@@ -217,10 +424,10 @@ func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
 		x.SetBytes(in.PubKey[:(keyLen / 2)])
 		y.SetBytes(in.PubKey[(keyLen / 2):])
 
-		rawPubKey := ecdsa.PublicKey{curve, &x, &y}
+		rawPubKey := ecdsa.PublicKey{Curve: curve, X: &x, Y: &y}
 
-		// Verify the signature
-		if ecdsa.Verify(&rawPubKey, in.ID, &r, &s) == false {
+		// Verify the signature on the ID of the transaction copy
+		if ecdsa.Verify(&rawPubKey, txCopy.ID, &r, &s) == false {
 			return false
 		}
 	}
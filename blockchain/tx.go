@@ -2,12 +2,14 @@ package blockchain
 
 import (
 	"bytes"
+	"fmt"
 
 	"github.com/tezansahu/golang_blockchain/wallet"
 )
 
 // Structure of a transaction in a block
 type Transaction struct {
+	Version int // Version of the transaction, deciding how it is hashed
 	ID      []byte
 	Inputs  []TxInput
 	Outputs []TxOutput
@@ -35,13 +37,21 @@ func (in *TxInput) UsesKey(pubKeyHash []byte) bool {
 }
 
 // Lock a Transaction Output using Public Key Hash of calling user
-func (out *TxOutput) Lock(address []byte) {
+func (out *TxOutput) Lock(address []byte) error {
 	// Get the public key hash of the user from his wallet data
-	pubKeyHash := wallet.Base58Decode(address)
+	pubKeyHash, err := wallet.Base58Decode(address)
+	if err != nil {
+		return err
+	}
+	if len(pubKeyHash) <= 1+wallet.ChecksumLength {
+		return fmt.Errorf("%w: %q", wallet.ErrInvalidAddress, address)
+	}
 	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-wallet.ChecksumLength]
 
 	// Lock the transaction output using this public key hash
 	out.PubKeyHash = pubKeyHash
+
+	return nil
 }
 
 // Check if a Transaction Output is locked with Public Key Hash of calling user
@@ -50,9 +60,11 @@ func (out *TxOutput) IsLockedWithKey(pubKeyHash []byte) bool {
 }
 
 // Create a new Transaction Output
-func NewTXOutput(value int, address string) *TxOutput {
+func NewTXOutput(value int, address string) (*TxOutput, error) {
 	txo := TxOutput{value, nil}
 
-	txo.Lock([]byte(address))
-	return &txo
+	if err := txo.Lock([]byte(address)); err != nil {
+		return nil, err
+	}
+	return &txo, nil
 }
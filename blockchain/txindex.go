@@ -0,0 +1,63 @@
+package blockchain
+
+import (
+	"github.com/dgraph-io/badger"
+)
+
+// Prefix of the keys under which the transaction index is stored in the database
+var txIndexPrefix = []byte("tx-")
+
+// Location of a transaction in the blockchain
+type TxLocation struct {
+	BlockHash []byte // Hash of the block containing the transaction
+	Position  int    // Index of the transaction in the Transactions slice of that block
+}
+
+// Create the database key of a transaction in the index using its ID
+func txIndexKey(txID []byte) []byte {
+	return append(append([]byte{}, txIndexPrefix...), txID...)
+}
+
+// Function to serialize a transaction location into bytes, using the canonical encoding
+func (loc TxLocation) Serialize() []byte {
+	var e encoder
+	encodeTxLocation(&e, loc)
+
+	return e.buf.Bytes()
+}
+
+// Function to deserialize a transaction location from bytes
+func DeserializeTxLocation(data []byte) (TxLocation, error) {
+	d := &decoder{data: data}
+	loc := decodeTxLocation(d)
+
+	return loc, d.finish()
+}
+
+// Add the transactions of a block to the transaction index within a database transaction
+func indexTransactions(txn *badger.Txn, block *Block) error {
+	for i, tx := range block.Transactions {
+		loc := TxLocation{block.Hash, i}
+		if err := txn.Set(txIndexKey(tx.ID), loc.Serialize()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Rebuild the transaction index from scratch by scanning the whole blockchain
+func (chain *Blockchain) ReindexTransactions() error {
+	return chain.rebuildIndex(txIndexPrefix, func(txn *badger.Txn) (map[string][]byte, error) {
+		entries := make(map[string][]byte)
+
+		err := walkChain(txn, func(block *Block) {
+			for i, tx := range block.Transactions {
+				loc := TxLocation{block.Hash, i}
+				entries[string(txIndexKey(tx.ID))] = loc.Serialize()
+			}
+		})
+
+		return entries, err
+	})
+}
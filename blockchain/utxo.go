@@ -0,0 +1,391 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+
+	"github.com/dgraph-io/badger"
+)
+
+// Prefix of the keys under which the UTXO set is stored in the database
+var utxoPrefix = []byte("utxo-")
+
+// Structure of an entry of the UTXO set
+type UTXO struct {
+	TxID     []byte   // ID of the transaction that created the output
+	Out      int      // Index of the output in the Outputs slice of that transaction
+	Output   TxOutput // The unspent output itself
+	Height   int      // Height of the block containing the transaction
+	Coinbase bool     // Whether the transaction is a coinbase transaction
+}
+
+// Set of all Unspent Transaction Outputs of a blockchain, kept in the database
+// so that balance and coin selection queries do not need to scan the chain
+type UTXOSet struct {
+	Blockchain *Blockchain
+}
+
+// Create the database key of an output, using the ID of its transaction and its index
+func utxoKey(txID []byte, out int) []byte {
+	index := make([]byte, 4)
+	binary.BigEndian.PutUint32(index, uint32(out))
+
+	return bytes.Join([][]byte{utxoPrefix, txID, index}, []byte{})
+}
+
+// Function to serialize an entry of the UTXO set into bytes, using the canonical encoding
+func (u UTXO) Serialize() []byte {
+	var e encoder
+	encodeUTXO(&e, u)
+
+	return e.buf.Bytes()
+}
+
+// Function to deserialize an entry of the UTXO set from bytes
+func DeserializeUTXO(data []byte) (UTXO, error) {
+	d := &decoder{data: data}
+	utxo := decodeUTXO(d)
+
+	return utxo, d.finish()
+}
+
+// Check if the output can be spent by a transaction of the block at the given
+// height, which is not the case of coinbase outputs that have not matured yet:
+// a coinbase at height h can be spent from height h + maturity
+func (u UTXO) Spendable(height, maturity int) bool {
+	return !u.Coinbase || height-u.Height >= maturity
+}
+
+// Get an entry of the UTXO set within a database transaction
+func getUTXO(txn *badger.Txn, txID []byte, out int) (UTXO, error) {
+	item, err := txn.Get(utxoKey(txID, out))
+	if err != nil {
+		return UTXO{}, err
+	}
+	v, err := item.Value()
+	if err != nil {
+		return UTXO{}, err
+	}
+
+	return DeserializeUTXO(v)
+}
+
+// Iterate through all entries of the UTXO set, calling fn on each of them
+func (u UTXOSet) forEach(fn func(utxo UTXO) bool) error {
+	return u.Blockchain.Database.View(func(txn *badger.Txn) error {
+		return forEachUTXO(txn, fn)
+	})
+}
+
+// Iterate through all entries of the UTXO set like forEach, passing fn the
+// height of the next block and the outputs spent by pending transactions of the
+// mempool, which decide whether an entry can be spent. All of them are read
+// from the same snapshot of the database, even while blocks are being added.
+func (u UTXOSet) forEachAtTip(fn func(utxo UTXO, height int, pending map[string]bool) bool) error {
+	return u.Blockchain.Database.View(func(txn *badger.Txn) error {
+		lastBlock, err := getLastBlock(txn)
+		if err != nil {
+			return err
+		}
+		pending, err := mempoolSpentOutputs(txn)
+		if err != nil {
+			return err
+		}
+
+		return forEachUTXO(txn, func(utxo UTXO) bool {
+			return fn(utxo, lastBlock.Height+1, pending)
+		})
+	})
+}
+
+// Iterate through all entries of the UTXO set within a database transaction,
+// calling fn on each of them until it returns false
+func forEachUTXO(txn *badger.Txn, fn func(utxo UTXO) bool) error {
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+
+	for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
+		v, err := it.Item().Value()
+		if err != nil {
+			return err
+		}
+
+		utxo, err := DeserializeUTXO(v)
+		if err != nil {
+			return err
+		}
+		if !fn(utxo) {
+			break
+		}
+	}
+
+	return nil
+}
+
+// Find all Unspent Transaction Outputs for a user
+func (u UTXOSet) FindUTXO(pubKeyHash []byte) ([]TxOutput, error) {
+	var UTXOs []TxOutput
+
+	err := u.forEach(func(utxo UTXO) bool {
+		if utxo.Output.IsLockedWithKey(pubKeyHash) {
+			UTXOs = append(UTXOs, utxo.Output)
+		}
+		return true
+	})
+
+	return UTXOs, err
+}
+
+// Find the balance of a user, split between the outputs that can be spent in
+// the next block and the coinbase outputs that have not matured yet
+func (u UTXOSet) Balance(pubKeyHash []byte) (int, int, error) {
+	balance, immature := 0, 0
+
+	err := u.forEachAtTip(func(utxo UTXO, height int, pending map[string]bool) bool {
+		if !utxo.Output.IsLockedWithKey(pubKeyHash) {
+			return true
+		}
+
+		if utxo.Spendable(height, u.Blockchain.Params.CoinbaseMaturity) {
+			balance += utxo.Output.Value
+		} else {
+			immature += utxo.Output.Value
+		}
+		return true
+	})
+
+	return balance, immature, err
+}
+
+// Given a user and amount to be spent, find unspent outputs of the user that
+// add up to at least that amount. Outputs already spent by a pending
+// transaction of the mempool are left out, and so are immature coinbase outputs.
+func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[string][]int, error) {
+	unspentOutputs := make(map[string][]int)
+	accumulated := 0
+
+	err := u.forEachAtTip(func(utxo UTXO, height int, pending map[string]bool) bool {
+		if utxo.Output.IsLockedWithKey(pubKeyHash) && utxo.Spendable(height, u.Blockchain.Params.CoinbaseMaturity) && !pending[string(utxoKey(utxo.TxID, utxo.Out))] {
+			txId := hex.EncodeToString(utxo.TxID)
+			accumulated += utxo.Output.Value
+			unspentOutputs[txId] = append(unspentOutputs[txId], utxo.Out)
+		}
+
+		// Stop iterating once the required amount has been accumulated
+		return accumulated < amount
+	})
+
+	return accumulated, unspentOutputs, err
+}
+
+// Find the outputs of the given users that can be spent by a transaction of
+// the next block: immature coinbase outputs and outputs already spent by a
+// pending transaction of the mempool are left out
+func (u UTXOSet) SpendableUTXOs(pubKeyHashes [][]byte) ([]UTXO, error) {
+	var UTXOs []UTXO
+
+	err := u.forEachAtTip(func(utxo UTXO, height int, pending map[string]bool) bool {
+		if !utxo.Spendable(height, u.Blockchain.Params.CoinbaseMaturity) || pending[string(utxoKey(utxo.TxID, utxo.Out))] {
+			return true
+		}
+
+		for _, pubKeyHash := range pubKeyHashes {
+			if utxo.Output.IsLockedWithKey(pubKeyHash) {
+				UTXOs = append(UTXOs, utxo)
+				break
+			}
+		}
+		return true
+	})
+
+	return UTXOs, err
+}
+
+// Count the number of outputs in the UTXO set
+func (u UTXOSet) Count() (int, error) {
+	counter := 0
+
+	err := u.forEach(func(utxo UTXO) bool {
+		counter++
+		return true
+	})
+
+	return counter, err
+}
+
+// Add up the values of all outputs in the UTXO set
+func (u UTXOSet) TotalValue() (int, error) {
+	total := 0
+
+	err := u.forEach(func(utxo UTXO) bool {
+		total += utxo.Output.Value
+		return true
+	})
+
+	return total, err
+}
+
+// Rebuild the UTXO set from scratch by scanning the whole blockchain
+func (u UTXOSet) Reindex() error {
+	return u.Blockchain.rebuildIndex(utxoPrefix, func(txn *badger.Txn) (map[string][]byte, error) {
+		UTXOs, err := findUTXO(txn)
+		if err != nil {
+			return nil, err
+		}
+
+		entries := make(map[string][]byte)
+		for _, utxo := range UTXOs {
+			entries[string(utxoKey(utxo.TxID, utxo.Out))] = utxo.Serialize()
+		}
+
+		return entries, nil
+	})
+}
+
+// Replace all keys with the given prefix by the entries built from the chain
+// within a database transaction. The write lock is held throughout, so that no
+// block is added in the meantime, and the keys are replaced within the same
+// database transaction as the chain is read, so that readers never see them
+// half rebuilt. Only when the entries do not fit into a single database
+// transaction are they replaced in chunks.
+func (chain *Blockchain) rebuildIndex(prefix []byte, build func(txn *badger.Txn) (map[string][]byte, error)) error {
+	chain.mu.Lock()
+	defer chain.mu.Unlock()
+
+	var entries map[string][]byte
+
+	err := chain.update(func(txn *badger.Txn) error {
+		var err error
+		if entries, err = build(txn); err != nil {
+			return err
+		}
+
+		keys, err := keysWithPrefix(txn, prefix)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := txn.Delete(key); err != nil {
+				return err
+			}
+		}
+
+		for key, value := range entries {
+			if err := txn.Set([]byte(key), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err != badger.ErrTxnTooBig {
+		return err
+	}
+
+	if err := deleteByPrefix(chain.Database, prefix); err != nil {
+		return err
+	}
+
+	return writeBatch(chain.Database, entries)
+}
+
+// Get all keys with the given prefix within a database transaction
+func keysWithPrefix(txn *badger.Txn, prefix []byte) ([][]byte, error) {
+	var keys [][]byte
+
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		keys = append(keys, it.Item().KeyCopy(nil))
+	}
+
+	return keys, nil
+}
+
+// Update the UTXO set with the transactions of a newly added block
+func (u *UTXOSet) Update(block *Block) error {
+	return u.Blockchain.Database.Update(func(txn *badger.Txn) error {
+		return updateUTXO(txn, block)
+	})
+}
+
+// Update the UTXO set within a database transaction: remove the outputs spent
+// by the block and add the outputs it creates
+func updateUTXO(txn *badger.Txn, block *Block) error {
+	for _, tx := range block.Transactions {
+		if tx.IsCoinbase() == false {
+			for _, in := range tx.Inputs {
+				if err := txn.Delete(utxoKey(in.ID, in.Out)); err != nil {
+					return err
+				}
+			}
+		}
+
+		for outIdx, out := range tx.Outputs {
+			utxo := UTXO{tx.ID, outIdx, out, block.Height, tx.IsCoinbase()}
+			if err := txn.Set(utxoKey(tx.ID, outIdx), utxo.Serialize()); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Delete all keys with the given prefix, committing in chunks that fit into a single database transaction
+func deleteByPrefix(db *badger.DB, prefix []byte) error {
+	var keys [][]byte
+
+	err := db.View(func(txn *badger.Txn) error {
+		var err error
+		keys, err = keysWithPrefix(txn, prefix)
+		return err
+	})
+
+	if err != nil {
+		return err
+	}
+
+	txn := db.NewTransaction(true)
+	defer func() { txn.Discard() }()
+	for _, key := range keys {
+		err := txn.Delete(key)
+		if err == badger.ErrTxnTooBig {
+			if err := txn.Commit(nil); err != nil {
+				return err
+			}
+			txn = db.NewTransaction(true)
+			err = txn.Delete(key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return txn.Commit(nil)
+}
+
+// Write the given key-value pairs, committing in chunks that fit into a single database transaction
+func writeBatch(db *badger.DB, entries map[string][]byte) error {
+	txn := db.NewTransaction(true)
+	defer func() { txn.Discard() }()
+	for key, value := range entries {
+		err := txn.Set([]byte(key), value)
+		if err == badger.ErrTxnTooBig {
+			if err := txn.Commit(nil); err != nil {
+				return err
+			}
+			txn = db.NewTransaction(true)
+			err = txn.Set([]byte(key), value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return txn.Commit(nil)
+}
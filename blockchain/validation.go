@@ -0,0 +1,314 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dgraph-io/badger"
+)
+
+// Errors describing the rule that a block or one of its transactions failed
+var (
+	ErrInvalidPoW          = errors.New("proof of work is not valid")
+	ErrInvalidMerkleRoot   = errors.New("Merkle root does not match the transactions")
+	ErrPrevHashMismatch    = errors.New("previous hash does not match the last block of the chain")
+	ErrUnknownParent       = errors.New("previous block is not known")
+	ErrKnownBlock          = errors.New("block is already stored")
+	ErrInvalidHeight       = errors.New("height does not follow the last block of the chain")
+	ErrInvalidDifficulty   = errors.New("difficulty does not follow the retarget rule")
+	ErrTimestampTooEarly   = errors.New("timestamp is before the timestamp of the previous block")
+	ErrTimestampTooLate    = errors.New("timestamp is too far in the future")
+	ErrInvalidCoinbase     = errors.New("block must have exactly one coinbase transaction, in first position")
+	ErrInvalidTxID         = errors.New("transaction ID does not match its contents")
+	ErrDuplicateTx         = errors.New("transaction is already in the chain")
+	ErrRepeatedTx          = errors.New("transaction appears more than once in the block")
+	ErrNegativeOutput      = errors.New("transaction output has a negative value")
+	ErrValueOutOfRange     = errors.New("transaction values add up to more than the maximum supply")
+	ErrMissingInput        = errors.New("transaction input refers to an output that is spent or does not exist")
+	ErrDoubleSpend         = errors.New("output is spent more than once in the block")
+	ErrInvalidSignature    = errors.New("transaction signature is not valid")
+	ErrOutputsExceedInputs = errors.New("transaction outputs exceed its inputs")
+	ErrCoinbaseOverpays    = errors.New("coinbase claims more than the subsidy plus the fees of the block")
+	ErrImmatureCoinbase    = errors.New("transaction spends a coinbase output that has not matured yet")
+)
+
+// Error returned when a block fails validation, recording which block and
+// transaction broke which rule
+type ValidationError struct {
+	BlockHash []byte
+	TxID      []byte
+	Err       error
+}
+
+func (e *ValidationError) Error() string {
+	switch {
+	case e.BlockHash == nil:
+		return fmt.Sprintf("transaction %x rejected: %v", e.TxID, e.Err)
+	case e.TxID == nil:
+		return fmt.Sprintf("block %x rejected: %v", e.BlockHash, e.Err)
+	default:
+		return fmt.Sprintf("block %x rejected: transaction %x: %v", e.BlockHash, e.TxID, e.Err)
+	}
+}
+
+// Get the rule that was broken, so that callers can use errors.Is on a ValidationError
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// Validate a block against the current state of the blockchain
+func (chain *Blockchain) ValidateBlock(block *Block) error {
+	return chain.Database.View(func(txn *badger.Txn) error {
+		return chain.validateBlock(txn, block)
+	})
+}
+
+// Validate a block within a database transaction: its seal, its position on
+// top of the last block, and all of its transactions
+func (chain *Blockchain) validateBlock(txn *badger.Txn, block *Block) error {
+	lastBlock, err := getLastBlock(txn)
+	if err != nil {
+		return err
+	}
+
+	if bytes.Compare(block.PrevHash, lastBlock.Hash) != 0 {
+		return &ValidationError{block.Hash, nil, ErrPrevHashMismatch}
+	}
+	if err := chain.validateHeader(txn, block, lastBlock); err != nil {
+		return err
+	}
+	if err := checkUnknownBlock(txn, block); err != nil {
+		return err
+	}
+
+	return chain.validateBlockTransactions(txn, block)
+}
+
+// Validate the header of a block within a database transaction: its height,
+// timestamp and difficulty following its parent, its seal and its Merkle root.
+// The difficulty is checked first, as the seal is only meaningful for the
+// expected one. Its transactions can only be checked once the chain reaches
+// its parent. Since the difficulty is retargeted from the timestamps, these
+// must increase from block to block and stay within MaxFutureDrift of the clock.
+func (chain *Blockchain) validateHeader(txn *badger.Txn, block *Block, parent *Block) error {
+	// Legacy blocks are only valid in the chains migrated from before they were
+	// replaced, since their hash covers neither their height nor their timestamp
+	if block.Version != BlockVersion {
+		return &ValidationError{block.Hash, nil, ErrUnknownVersion}
+	}
+
+	if block.Height != parent.Height+1 {
+		return &ValidationError{block.Hash, nil, ErrInvalidHeight}
+	}
+
+	if block.Timestamp < parent.Timestamp {
+		return &ValidationError{block.Hash, nil, ErrTimestampTooEarly}
+	}
+	if block.Timestamp > time.Now().Add(MaxFutureDrift).Unix() {
+		return &ValidationError{block.Hash, nil, ErrTimestampTooLate}
+	}
+
+	difficulty, err := chain.Engine.Difficulty(txnReader{txn}, parent)
+	if err != nil {
+		return err
+	}
+	if block.Difficulty != difficulty {
+		return &ValidationError{block.Hash, nil, ErrInvalidDifficulty}
+	}
+
+	if err := chain.Engine.Verify(txnReader{txn}, block); err != nil {
+		return &ValidationError{block.Hash, nil, err}
+	}
+	if txID := repeatedTx(block); txID != nil {
+		return &ValidationError{block.Hash, txID, ErrRepeatedTx}
+	}
+	if bytes.Compare(block.MerkleRoot, block.HashTransactions()) != 0 {
+		return &ValidationError{block.Hash, nil, ErrInvalidMerkleRoot}
+	}
+
+	return nil
+}
+
+// Find a transaction appearing more than once in a block. Repeating the last
+// transactions of a block can leave its Merkle root, and so its hash, unchanged
+// (the last node of a level is paired with itself), so such a block must be
+// rejected before it is stored, where it would shadow the valid block.
+func repeatedTx(block *Block) []byte {
+	seen := make(map[string]bool)
+
+	for _, tx := range block.Transactions {
+		if seen[string(tx.ID)] {
+			return tx.ID
+		}
+		seen[string(tx.ID)] = true
+	}
+
+	return nil
+}
+
+// Check within a database transaction that a block is not stored yet, on the
+// main chain or on a side chain
+func checkUnknownBlock(txn *badger.Txn, block *Block) error {
+	if _, err := txn.Get(block.Hash); err == nil {
+		return &ValidationError{block.Hash, nil, ErrKnownBlock}
+	} else if err != badger.ErrKeyNotFound {
+		return err
+	}
+
+	return nil
+}
+
+// Validate the transactions of a block within a database transaction, on top
+// of its parent which must be the last block of the chain
+func (chain *Blockchain) validateBlockTransactions(txn *badger.Txn, block *Block) error {
+	if err := chain.validateTransactions(txn, block.Height, block.Transactions); err != nil {
+		if verr, ok := err.(*ValidationError); ok {
+			verr.BlockHash = block.Hash
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Validate the transactions of a block within a database transaction: there
+// must be exactly one coinbase, in first position, and every other transaction
+// must spend unspent outputs, be correctly signed and not create money. The
+// coinbase may claim at most the subsidy of the block at the given height plus
+// the fees of the other transactions.
+func (chain *Blockchain) validateTransactions(txn *badger.Txn, height int, txs []*Transaction) error {
+	if len(txs) == 0 {
+		return &ValidationError{nil, nil, ErrInvalidCoinbase}
+	}
+
+	// Outputs spent so far in the block, and transactions seen so far
+	// (whose outputs can be spent by later transactions of the block)
+	spent := make(map[string]bool)
+	seen := make(map[string]Transaction)
+	fees := 0
+
+	for i, tx := range txs {
+		if tx.IsCoinbase() != (i == 0) {
+			return &ValidationError{nil, tx.ID, ErrInvalidCoinbase}
+		}
+
+		fee, err := chain.validateTransaction(txn, height, tx, spent, seen)
+		if err != nil {
+			return err
+		}
+		fees += fee
+
+		seen[hex.EncodeToString(tx.ID)] = *tx
+	}
+
+	coinbase := txs[0]
+	claimed := 0
+	for _, out := range coinbase.Outputs {
+		claimed += out.Value
+	}
+	if claimed > chain.Params.BlockSubsidy(height)+fees {
+		return &ValidationError{nil, coinbase.ID, ErrCoinbaseOverpays}
+	}
+
+	return nil
+}
+
+// Validate a single transaction of the block at the given height within a
+// database transaction, given the outputs already spent and the transactions
+// already seen in the same block, and return its fee. The outputs it spends are
+// added to the spent ones. No output, nor the total of the outputs or of the
+// inputs, may exceed the maximum supply of the chain, so that sums never overflow.
+func (chain *Blockchain) validateTransaction(txn *badger.Txn, height int, tx *Transaction, spent map[string]bool, seen map[string]Transaction) (int, error) {
+	if tx.Version < LegacyTxVersion || tx.Version > TxVersion {
+		return 0, &ValidationError{nil, tx.ID, ErrUnknownVersion}
+	}
+
+	if bytes.Compare(tx.ID, tx.UnsignedHash()) != 0 {
+		return 0, &ValidationError{nil, tx.ID, ErrInvalidTxID}
+	}
+
+	txId := hex.EncodeToString(tx.ID)
+	if _, err := txn.Get(txIndexKey(tx.ID)); err == nil || seen[txId].ID != nil {
+		return 0, &ValidationError{nil, tx.ID, ErrDuplicateTx}
+	} else if err != badger.ErrKeyNotFound {
+		return 0, err
+	}
+
+	outputSum := 0
+	for _, out := range tx.Outputs {
+		if out.Value < 0 {
+			return 0, &ValidationError{nil, tx.ID, ErrNegativeOutput}
+		}
+		if !chain.Params.moneyRange(out.Value) || !chain.Params.moneyRange(outputSum+out.Value) {
+			return 0, &ValidationError{nil, tx.ID, ErrValueOutOfRange}
+		}
+		outputSum += out.Value
+	}
+
+	if tx.IsCoinbase() {
+		return 0, nil
+	}
+
+	prevTXs := make(map[string]Transaction)
+	inputSum := 0
+
+	for _, in := range tx.Inputs {
+		inTxID := hex.EncodeToString(in.ID)
+		outpoint := fmt.Sprintf("%s:%d", inTxID, in.Out)
+
+		if spent[outpoint] {
+			return 0, &ValidationError{nil, tx.ID, ErrDoubleSpend}
+		}
+		spent[outpoint] = true
+
+		// The referenced output is either created earlier in the block or must be in the UTXO set
+		if prevTx, ok := seen[inTxID]; ok {
+			if in.Out < 0 || in.Out >= len(prevTx.Outputs) {
+				return 0, &ValidationError{nil, tx.ID, ErrMissingInput}
+			}
+			if !(UTXO{Height: height, Coinbase: prevTx.IsCoinbase()}).Spendable(height, chain.Params.CoinbaseMaturity) {
+				return 0, &ValidationError{nil, tx.ID, ErrImmatureCoinbase}
+			}
+			value := prevTx.Outputs[in.Out].Value
+			if !chain.Params.moneyRange(value) || !chain.Params.moneyRange(inputSum+value) {
+				return 0, &ValidationError{nil, tx.ID, ErrValueOutOfRange}
+			}
+			prevTXs[inTxID] = prevTx
+			inputSum += value
+			continue
+		}
+
+		utxo, err := getUTXO(txn, in.ID, in.Out)
+		if err == badger.ErrKeyNotFound {
+			return 0, &ValidationError{nil, tx.ID, ErrMissingInput}
+		} else if err != nil {
+			return 0, err
+		}
+		if !utxo.Spendable(height, chain.Params.CoinbaseMaturity) {
+			return 0, &ValidationError{nil, tx.ID, ErrImmatureCoinbase}
+		}
+
+		prevTx, _, err := findTransactionBlock(txn, in.ID)
+		if err != nil {
+			return 0, err
+		}
+		if !chain.Params.moneyRange(utxo.Output.Value) || !chain.Params.moneyRange(inputSum+utxo.Output.Value) {
+			return 0, &ValidationError{nil, tx.ID, ErrValueOutOfRange}
+		}
+		prevTXs[inTxID] = prevTx
+		inputSum += utxo.Output.Value
+	}
+
+	if !tx.Verify(prevTXs) {
+		return 0, &ValidationError{nil, tx.ID, ErrInvalidSignature}
+	}
+
+	if inputSum < outputSum {
+		return 0, &ValidationError{nil, tx.ID, ErrOutputsExceedInputs}
+	}
+
+	return inputSum - outputSum, nil
+}
@@ -0,0 +1,277 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/dgraph-io/badger"
+)
+
+// Levels of checks performed when verifying the chain, each one including the checks of the previous levels
+const (
+	VerifyLinkage    = iota // Hash linkage, heights, difficulty and seal of every block
+	VerifyMerkle            // Merkle roots and transaction IDs
+	VerifySignatures        // Coinbase placement and reward, transaction index and signatures of every input
+	VerifyUTXO              // Consistency of the stored UTXO set with the one implied by the chain
+)
+
+// Errors describing the kind of corruption found while verifying the chain
+var (
+	ErrMissingBlock  = errors.New("block is missing or cannot be decoded")
+	ErrBrokenLink    = errors.New("block is not stored under its own hash")
+	ErrBadTxIndex    = errors.New("transaction index does not point to the block")
+	ErrUTXOMismatch  = errors.New("UTXO set does not match the outputs left unspent by the chain")
+	ErrInvalidOutput = errors.New("transaction input refers to an output that does not exist")
+)
+
+// Error returned when the chain is found to be corrupted, recording the first corrupted block
+type CorruptionError struct {
+	BlockHash []byte
+	Height    int
+	TxID      []byte
+	Err       error
+}
+
+func (e *CorruptionError) Error() string {
+	if e.TxID != nil {
+		return fmt.Sprintf("block %x at height %d is corrupted: transaction %x: %v", e.BlockHash, e.Height, e.TxID, e.Err)
+	}
+	return fmt.Sprintf("block %x at height %d is corrupted: %v", e.BlockHash, e.Height, e.Err)
+}
+
+// Get the kind of corruption, so that callers can use errors.Is on a CorruptionError
+func (e *CorruptionError) Unwrap() error {
+	return e.Err
+}
+
+// Walk the chain from the last block to the genesis block, checking every block
+// up to the given level, and return the number of blocks checked. The first
+// corrupted block found is reported as a CorruptionError.
+func (chain *Blockchain) VerifyChain(level int) (int, error) {
+	count := 0
+
+	// Check the chain as of a single snapshot of the database, even while blocks are being added
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		hash, err := getLastHash(txn)
+		if err != nil {
+			return err
+		}
+		height := -1
+
+		for {
+			item, err := txn.Get(hash)
+			if err != nil {
+				return &CorruptionError{hash, height, nil, ErrMissingBlock}
+			}
+			encodedBlock, err := item.Value()
+			if err != nil {
+				return err
+			}
+			block, err := decodeBlock(encodedBlock)
+			if err != nil {
+				return &CorruptionError{hash, height, nil, ErrMissingBlock}
+			}
+
+			if err := chain.verifyBlock(txn, block, hash, height, level); err != nil {
+				return err
+			}
+			count++
+
+			if len(block.PrevHash) == 0 {
+				break
+			}
+			hash = block.PrevHash
+			height = block.Height - 1
+		}
+
+		if level < VerifyUTXO {
+			return nil
+		}
+
+		return verifyUTXO(txn)
+	})
+
+	return count, err
+}
+
+// Check a single block stored under the given key, whose height is expected
+// to be the given one (or anything, for the last block of the chain)
+func (chain *Blockchain) verifyBlock(txn *badger.Txn, block *Block, key []byte, height, level int) error {
+	corrupted := func(txID []byte, err error) error {
+		return &CorruptionError{key, block.Height, txID, err}
+	}
+
+	if bytes.Compare(block.Hash, key) != 0 {
+		return corrupted(nil, ErrBrokenLink)
+	}
+	if (height >= 0 && block.Height != height) || (len(block.PrevHash) == 0) != (block.Height == 0) {
+		return corrupted(nil, ErrInvalidHeight)
+	}
+	if err := chain.Engine.Verify(txnReader{txn}, block); err != nil {
+		return corrupted(nil, err)
+	}
+
+	// Historic blocks must carry the difficulty given by the engine at their
+	// height, except legacy blocks which were all mined with the same one
+	var parent *Block
+	if len(block.PrevHash) != 0 {
+		var err error
+		parent, err = getBlock(txn, block.PrevHash)
+		if err != nil {
+			return corrupted(nil, ErrMissingBlock)
+		}
+	}
+	if block.Version == LegacyBlockVersion {
+		if block.Difficulty != legacyDifficulty || (parent != nil && parent.Version != LegacyBlockVersion) {
+			return corrupted(nil, ErrInvalidDifficulty)
+		}
+	} else if block.Version == BlockVersion {
+		difficulty, err := chain.Engine.Difficulty(txnReader{txn}, parent)
+		if err != nil || block.Difficulty != difficulty {
+			return corrupted(nil, ErrInvalidDifficulty)
+		}
+	} else {
+		return corrupted(nil, ErrUnknownVersion)
+	}
+
+	if level < VerifyMerkle {
+		return nil
+	}
+
+	if txID := repeatedTx(block); txID != nil {
+		return corrupted(txID, ErrRepeatedTx)
+	}
+	if bytes.Compare(block.MerkleRoot, block.HashTransactions()) != 0 {
+		return corrupted(nil, ErrInvalidMerkleRoot)
+	}
+	for _, tx := range block.Transactions {
+		if bytes.Compare(tx.ID, tx.UnsignedHash()) != 0 {
+			return corrupted(tx.ID, ErrInvalidTxID)
+		}
+	}
+
+	if level < VerifySignatures {
+		return nil
+	}
+
+	// Legacy blocks had no coinbase, except the genesis block, and no fees
+	legacy := block.Version == LegacyBlockVersion
+	if len(block.Transactions) == 0 && !legacy {
+		return corrupted(nil, ErrInvalidCoinbase)
+	}
+
+	fees := 0
+	for i, tx := range block.Transactions {
+		if tx.IsCoinbase() != (i == 0) && !legacy {
+			return corrupted(tx.ID, ErrInvalidCoinbase)
+		}
+
+		_, indexed, err := findTransactionBlock(txn, tx.ID)
+		if err != nil || bytes.Compare(indexed.Hash, block.Hash) != 0 {
+			return corrupted(tx.ID, ErrBadTxIndex)
+		}
+
+		if tx.IsCoinbase() {
+			continue
+		}
+
+		prevTXs := make(map[string]Transaction)
+		for _, in := range tx.Inputs {
+			prevTx, prevBlock, err := findTransactionBlock(txn, in.ID)
+			if err != nil || in.Out < 0 || in.Out >= len(prevTx.Outputs) {
+				return corrupted(tx.ID, ErrInvalidOutput)
+			}
+			// Coinbase outputs could be spent right away in legacy blocks
+			immature := !(UTXO{Height: prevBlock.Height, Coinbase: prevTx.IsCoinbase()}).Spendable(block.Height, chain.Params.CoinbaseMaturity)
+			if immature && !legacy {
+				return corrupted(tx.ID, ErrImmatureCoinbase)
+			}
+			prevTXs[hex.EncodeToString(in.ID)] = prevTx
+		}
+
+		if !tx.Verify(prevTXs) {
+			return corrupted(tx.ID, ErrInvalidSignature)
+		}
+
+		fee, err := chain.transactionFee(txn, tx)
+		if errors.Is(err, ErrValueOutOfRange) {
+			return corrupted(tx.ID, ErrValueOutOfRange)
+		} else if err != nil {
+			return corrupted(tx.ID, ErrInvalidOutput)
+		}
+		if fee < 0 {
+			return corrupted(tx.ID, ErrOutputsExceedInputs)
+		}
+		fees += fee
+	}
+
+	if legacy {
+		return nil
+	}
+
+	claimed := 0
+	for _, out := range block.Transactions[0].Outputs {
+		if !chain.Params.moneyRange(out.Value) || !chain.Params.moneyRange(claimed+out.Value) {
+			return corrupted(block.Transactions[0].ID, ErrValueOutOfRange)
+		}
+		claimed += out.Value
+	}
+	if claimed > chain.Params.BlockSubsidy(block.Height)+fees {
+		return corrupted(block.Transactions[0].ID, ErrCoinbaseOverpays)
+	}
+
+	return nil
+}
+
+// Check within a database transaction that the stored UTXO set holds exactly
+// the outputs left unspent by the chain
+func verifyUTXO(txn *badger.Txn) error {
+	UTXOs, err := findUTXO(txn)
+	if err != nil {
+		return err
+	}
+
+	expected := make(map[string]UTXO)
+	for _, utxo := range UTXOs {
+		expected[string(utxoKey(utxo.TxID, utxo.Out))] = utxo
+	}
+
+	var mismatch []byte
+	err = forEachUTXO(txn, func(utxo UTXO) bool {
+		key := string(utxoKey(utxo.TxID, utxo.Out))
+		want, ok := expected[key]
+		if !ok || want.Output.Value != utxo.Output.Value || bytes.Compare(want.Output.PubKeyHash, utxo.Output.PubKeyHash) != 0 ||
+			want.Height != utxo.Height || want.Coinbase != utxo.Coinbase {
+			mismatch = utxo.TxID
+			return false
+		}
+
+		delete(expected, key)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	// Any output not found in the stored UTXO set is missing from it
+	if mismatch == nil {
+		for _, utxo := range expected {
+			mismatch = utxo.TxID
+			break
+		}
+	}
+
+	if mismatch == nil {
+		return nil
+	}
+
+	// Report the block that created the mismatching output, if it can be found
+	_, block, err := findTransactionBlock(txn, mismatch)
+	if err != nil {
+		return &CorruptionError{nil, -1, mismatch, ErrUTXOMismatch}
+	}
+
+	return &CorruptionError{block.Hash, block.Height, mismatch, ErrUTXOMismatch}
+}
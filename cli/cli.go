@@ -1,36 +1,205 @@
 package cli
 
 import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"io/ioutil"
 	"os"
-	"runtime"
+	"os/signal"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/tezansahu/golang_blockchain/blockchain"
+	"github.com/tezansahu/golang_blockchain/merkle"
 	"github.com/tezansahu/golang_blockchain/wallet"
 )
 
 type CommandLine struct {
 	// blockchain *blockchain.Blockchain
+	dataDir string                 // Data directory, holding one subdirectory per network
+	network blockchain.Network     // Network whose chain and wallets are used
+	params  blockchain.ChainParams // Parameters of the chain of the network
+}
+
+// Environment variables giving the defaults of the -datadir and -network flags
+const (
+	dataDirEnv = "BLOCKCHAIN_DATADIR"
+	networkEnv = "BLOCKCHAIN_NETWORK"
+)
+
+// Structure of a file containing a Merkle proof of inclusion of a transaction in a block
+type proofFile struct {
+	TxID       string          `json:"txid"`
+	BlockHash  string          `json:"block"`
+	MerkleRoot string          `json:"root"`
+	Path       []proofFileStep `json:"path"`
+}
+
+// Structure of a step of the Merkle path in a proof file
+type proofFileStep struct {
+	Hash string `json:"hash"`
+	Left bool   `json:"left"`
+}
+
+// Recipients given by repeated -to flags, either as ADDRESS:AMOUNT or as a
+// plain ADDRESS (with an amount of 0, to be replaced by the -amount flag)
+type recipientsFlag []blockchain.Recipient
+
+func (r *recipientsFlag) String() string {
+	var recipients []string
+	for _, recipient := range *r {
+		recipients = append(recipients, fmt.Sprintf("%s:%d", recipient.Address, recipient.Amount))
+	}
+
+	return strings.Join(recipients, ",")
+}
+
+func (r *recipientsFlag) Set(value string) error {
+	parts := strings.SplitN(value, ":", 2)
+	recipient := blockchain.Recipient{Address: parts[0]}
+
+	if len(parts) == 2 {
+		amount, err := strconv.Atoi(parts[1])
+		if err != nil || amount <= 0 {
+			return fmt.Errorf("amount of %s is not a positive integer", parts[0])
+		}
+		recipient.Amount = amount
+	}
+
+	*r = append(*r, recipient)
+	return nil
+}
+
+// Addresses given by repeated flags, each of them possibly a comma-separated list
+type addressesFlag []string
+
+func (a *addressesFlag) String() string {
+	return strings.Join(*a, ",")
+}
+
+func (a *addressesFlag) Set(value string) error {
+	for _, address := range strings.Split(value, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			*a = append(*a, address)
+		}
+	}
+
+	return nil
+}
+
+// Read the recipients of a transaction from a JSON file holding a list of
+// {"address": ADDRESS, "amount": AMOUNT} objects
+func (cli *CommandLine) readOutputsFile(path string) ([]blockchain.Recipient, error) {
+	var recipients []blockchain.Recipient
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &recipients); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	return recipients, nil
 }
 
 func (cli *CommandLine) printUsage() {
-	fmt.Println("Usage:")
+	fmt.Println("Usage: [-datadir DIR] [-network mainnet|testnet|regtest] COMMAND")
+	fmt.Printf("  -datadir and -network default to $%s and $%s, or to %s and %s\n", dataDirEnv, networkEnv, blockchain.DefaultDataDir, blockchain.DefaultNetwork)
+	fmt.Println("Commands:")
 	fmt.Println("  getbalance -address ADDRESS : Get the balance for an address")
-	fmt.Println("  createblockchain -address ADDRESS : Creates a blockchain whose genesis block is mined by the address")
+	fmt.Println("  createblockchain -address ADDRESS [-genesis FILE] [-workers N] [-progress] [-consensus pow|poa] [-signers PUBKEY,...] : Creates a blockchain whose genesis block is mined by the address")
 	fmt.Println("  print : Print the blocks in the chain")
-	fmt.Println("  send -from FROM -to TO -amount AMOUNT : Send amount from an address to another")
+	fmt.Println("  send -from FROM[,FROM...] (-to TO -amount AMOUNT | -to TO:AMOUNT ... | -outputs FILE) [-change ADDRESS] [-selector NAME] [-fee FEE | -feerate RATE] [-mine] [-workers N] [-progress] : Send amounts from addresses to others through the mempool")
+	fmt.Println("  mine -address ADDRESS [-count N] [-continuous] [-workers N] [-progress] : Mine blocks with the pending transactions of the mempool, rewarding the address")
+	fmt.Println("  mempool list : Print the pending transactions, by decreasing fee rate")
+	fmt.Println("  mempool drop -id TXID : Remove a pending transaction from the mempool")
 	fmt.Println("  createwallet : Creates a new Wallet")
 	fmt.Println("  listaddresses : Lists the addresses in our Wallets file")
+	fmt.Println("  reindexutxo : Rebuilds the UTXO set")
+	fmt.Println("  reindextx : Rebuilds the transaction index")
+	fmt.Println("  migratedb : Rewrites a database created with an older format, moving one found directly in the data directory to mainnet with its wallets")
+	fmt.Println("  gettx -id TXID : Print a transaction and the block containing it")
+	fmt.Println("  getblock -height HEIGHT | -hash HASH : Print the block at a height or with a hash")
+	fmt.Println("  getbestheight : Print the height of the last block in the chain")
+	fmt.Println("  getsupply : Print the number of tokens issued so far and still to be issued")
+	fmt.Println("  getproof -id TXID -out FILE : Export a Merkle proof that a transaction is included in its block")
+	fmt.Println("  verifyproof -file FILE : Check a Merkle proof against the block in the chain")
+	fmt.Println("  verifychain [-level LEVEL] : Check the integrity of the whole chain (levels 0-3)")
+	fmt.Println("  getpubkey -address ADDRESS : Print the public key of a wallet, as used to identify PoA signers")
+	fmt.Println("  listsigners : Print the PoA signers and the pending proposals of this node")
+	fmt.Println("  proposesigner -pubkey PUBKEY [-remove] [-discard] : Vote to add (or remove) a PoA signer in the blocks sealed by this node")
 }
 
-func (cli *CommandLine) validateArgs() {
-	if len(os.Args) < 2 {
+func (cli *CommandLine) validateArgs(args []string) bool {
+	if len(args) < 1 {
 		cli.printUsage()
-		runtime.Goexit()
+		return false
+	}
+
+	return true
+}
+
+// Parse the flags given before the command, selecting the data directory and
+// the network, and return the command with its own arguments
+func (cli *CommandLine) parseGlobalFlags() ([]string, error) {
+	globalFlags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	globalFlags.Usage = cli.printUsage
+
+	dataDir := os.Getenv(dataDirEnv)
+	if dataDir == "" {
+		dataDir = blockchain.DefaultDataDir
 	}
+	networkName := os.Getenv(networkEnv)
+	if networkName == "" {
+		networkName = blockchain.DefaultNetwork
+	}
+
+	globalFlags.StringVar(&cli.dataDir, "datadir", dataDir, "Data directory, holding one subdirectory per network")
+	globalFlags.StringVar(&networkName, "network", networkName, "Network to use: mainnet, testnet or regtest")
+
+	err := globalFlags.Parse(os.Args[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	cli.network, err = blockchain.GetNetwork(networkName)
+	if err != nil {
+		return nil, err
+	}
+
+	cli.params, err = blockchain.NetworkParams(cli.dataDir, cli.network)
+	if err != nil {
+		return nil, err
+	}
+
+	return globalFlags.Args(), nil
+}
+
+// Continue the blockchain of the selected network
+func (cli *CommandLine) continueBlockchain(address string) (*blockchain.Blockchain, error) {
+	return blockchain.ContinueBlockchain(cli.dataDir, cli.network, address)
+}
+
+// Load the wallets of the selected network, which are none until the first one is created
+func (cli *CommandLine) wallets() (*wallet.Wallets, error) {
+	wallets, err := wallet.CreateWallets(cli.network.DataDir(cli.dataDir))
+	if os.IsNotExist(err) {
+		return wallets, nil
+	}
+
+	return wallets, err
+}
+
+// Check that an address is valid on the selected network
+func (cli *CommandLine) validateAddress(address string) error {
+	return wallet.ValidateAddress(address, cli.params.AddressVersion)
 }
 
 // func (cli *CommandLine) addBlock(data string) {
@@ -38,95 +207,704 @@ func (cli *CommandLine) validateArgs() {
 // 	fmt.Println("Block Added!")
 // }
 
-func (cli *CommandLine) printChain() {
-	chain := blockchain.ContinueBlockchain("")
+func (cli *CommandLine) printBlock(chain *blockchain.Blockchain, block *blockchain.Block) {
+	fmt.Printf("Height: %d\n", block.Height)
+	fmt.Printf("Timestamp: %s\n", time.Unix(block.Timestamp, 0))
+	fmt.Printf("Previous Hash: %x\n", block.PrevHash)
+
+	fmt.Printf("Hash: %x\n", block.Hash)
+	fmt.Printf("Difficulty: %d\n", block.Difficulty)
+	fmt.Printf("Nonce: %d\n", block.Nonce)
+	fmt.Printf("Seal (%s): %s\n", chain.Engine.Name(), strconv.FormatBool(chain.Engine.Verify(chain, block) == nil))
+	if work, err := chain.ChainWork(block.Hash); err == nil {
+		fmt.Printf("Chain Work: %s\n", work)
+	}
+	if main, err := chain.InMainChain(block.Hash); err == nil {
+		fmt.Printf("Main Chain: %s\n", strconv.FormatBool(main))
+	}
+	for _, tx := range block.Transactions {
+		fmt.Println(tx)
+	}
+	fmt.Println()
+}
+
+func (cli *CommandLine) printChain() error {
+	chain, err := cli.continueBlockchain("")
+	if err != nil {
+		return err
+	}
 	defer chain.Database.Close()
 	iter := chain.Iterator()
 
 	for {
-		block := iter.Next()
-		fmt.Printf("Previous Hash: %x\n", block.PrevHash)
-
-		fmt.Printf("Hash: %x\n", block.Hash)
-		fmt.Printf("Nonce: %d\n", block.Nonce)
-		pow := blockchain.NewProof(block)
-		fmt.Printf("PoW: %s\n", strconv.FormatBool(pow.Validate()))
-		for _, tx := range block.Transactions {
-			fmt.Println(tx)
+		block, err := iter.Next()
+		if err != nil {
+			return err
 		}
-		fmt.Println()
+		cli.printBlock(chain, block)
 
 		if len(block.PrevHash) == 0 {
 			break
 		}
 
 	}
+
+	return nil
+}
+
+func (cli *CommandLine) getBlock(height int, hash string) error {
+	var blockHash []byte
+	if hash != "" {
+		var err error
+		blockHash, err = hex.DecodeString(hash)
+		if err != nil {
+			return errors.New("Block hash not valid")
+		}
+	}
+
+	chain, err := cli.continueBlockchain("")
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+
+	var block *blockchain.Block
+	if blockHash != nil {
+		block, err = chain.GetBlock(blockHash)
+	} else {
+		block, err = chain.GetBlockByHeight(height)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	cli.printBlock(chain, block)
+
+	return nil
 }
 
-func (cli *CommandLine) createBlockchain(address string) {
-	if !wallet.ValidateAddress(address) {
-		log.Panic("Address not valid")
+func (cli *CommandLine) getSupply() error {
+	chain, err := cli.continueBlockchain("")
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+
+	height, err := chain.GetBestHeight()
+	if err != nil {
+		return err
+	}
+	params := chain.Params
+	issued := params.Supply(height + 1)
+	unspent, err := blockchain.UTXOSet{Blockchain: chain}.TotalValue()
+	if err != nil {
+		return err
+	}
+	nextHalving := (height/params.HalvingInterval + 1) * params.HalvingInterval
+
+	fmt.Printf("Height: %d\n", height)
+	fmt.Printf("Issued: %d\n", issued)
+	fmt.Printf("Remaining: %d\n", params.TotalSupply()-issued)
+	fmt.Printf("Max supply: %d\n", params.MaxSupply)
+	fmt.Printf("Unspent: %d\n", unspent)
+	fmt.Printf("Next subsidy: %d (halving at height %d)\n", params.BlockSubsidy(height+1), nextHalving)
+
+	return nil
+}
+
+func (cli *CommandLine) getBestHeight() error {
+	chain, err := cli.continueBlockchain("")
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+
+	height, err := chain.GetBestHeight()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Best height: %d\n", height)
+
+	return nil
+}
+
+// Configure the miner used by the commands that mine blocks
+func (cli *CommandLine) configureMining(workers int, progress bool) {
+	if workers > 0 {
+		blockchain.MiningWorkers = workers
+	}
+
+	if progress {
+		blockchain.MiningProgress = func(status blockchain.MiningStatus) {
+			fmt.Printf("Mining: %d hashes in %s (%.0f H/s)\n", status.Hashes, status.Elapsed.Round(time.Millisecond), status.Hashrate)
+		}
+	}
+}
+
+func (cli *CommandLine) createBlockchain(address, consensus, signers, genesis string) error {
+	// Parameters given by a genesis file override the defaults of the network
+	network := cli.network
+	network.Params = cli.params
+	if genesis != "" {
+		params, err := blockchain.LoadChainParams(genesis, cli.network.Params)
+		if err != nil {
+			return err
+		}
+		network.Params = params
+	}
+
+	if err := wallet.ValidateAddress(address, network.Params.AddressVersion); err != nil {
+		return err
+	}
+
+	var engine blockchain.Consensus
+	switch consensus {
+	case "pow":
+		engine = blockchain.NewChainPoW(network.Params)
+	case "poa":
+		var keys [][]byte
+		for _, signer := range strings.Split(signers, ",") {
+			key, err := cli.decodePubKey(signer)
+			if err != nil {
+				return err
+			}
+			keys = append(keys, key)
+		}
+		engine = blockchain.NewPoA(keys, cli.network.DataDir(cli.dataDir))
+	default:
+		return fmt.Errorf("Unknown consensus engine %s", consensus)
+	}
+
+	chain, err := blockchain.InitBlockchain(cli.dataDir, network, address, engine)
+	if err != nil {
+		return err
 	}
-	chain := blockchain.InitBlockchain(address)
 	chain.Database.Close()
+	fmt.Println("Genesis Created")
 	fmt.Println("Finished!")
+
+	return nil
+}
+
+// Decode the hex public key of a PoA signer
+func (cli *CommandLine) decodePubKey(pubKey string) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(pubKey))
+	if err != nil || len(key) == 0 {
+		return nil, fmt.Errorf("Public key %s not valid", pubKey)
+	}
+
+	return key, nil
+}
+
+// Get the PoA engine of a chain, failing for chains using another engine
+func (cli *CommandLine) poaEngine(chain *blockchain.Blockchain) (*blockchain.PoA, error) {
+	engine, ok := chain.Engine.(*blockchain.PoA)
+	if !ok {
+		return nil, fmt.Errorf("Blockchain uses the %s consensus, not poa", chain.Engine.Name())
+	}
+
+	return engine, nil
+}
+
+func (cli *CommandLine) getPubKey(address string) error {
+	wallets, err := cli.wallets()
+	if err != nil {
+		return err
+	}
+
+	w, err := wallets.GetWallet(address)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Public key of %s: %x\n", address, w.PublicKey)
+
+	return nil
+}
+
+func (cli *CommandLine) listSigners() error {
+	chain, err := cli.continueBlockchain("")
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+	engine, err := cli.poaEngine(chain)
+	if err != nil {
+		return err
+	}
+
+	snap, err := engine.Snapshot(chain, chain.LastHash())
+	if err != nil {
+		return err
+	}
+
+	height, err := chain.GetBestHeight()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Signers after block %d:\n", height)
+	for _, signer := range snap.Signers {
+		turn := ""
+		if bytes.Equal(signer, snap.InTurn(height+1)) {
+			turn = " (in turn)"
+		}
+		fmt.Printf("  %x%s\n", signer, turn)
+	}
+
+	proposals, err := engine.Proposals()
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Pending proposals:")
+	for _, proposal := range proposals {
+		action := "remove"
+		if proposal.Authorize {
+			action = "add"
+		}
+		fmt.Printf("  %s %x\n", action, proposal.Signer)
+	}
+
+	return nil
+}
+
+func (cli *CommandLine) proposeSigner(pubKey string, remove, discard bool) error {
+	key, err := cli.decodePubKey(pubKey)
+	if err != nil {
+		return err
+	}
+
+	chain, err := cli.continueBlockchain("")
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+	engine, err := cli.poaEngine(chain)
+	if err != nil {
+		return err
+	}
+
+	if discard {
+		if err := engine.Discard(key); err != nil {
+			return err
+		}
+		fmt.Println("Proposal discarded.")
+		return nil
+	}
+
+	if err := engine.Propose(key, !remove); err != nil {
+		return err
+	}
+	fmt.Println("Proposal recorded. The signers of this node will vote for it in the blocks they seal.")
+
+	return nil
+}
+
+func (cli *CommandLine) reindexUTXO() error {
+	chain, err := cli.continueBlockchain("")
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
+	if err := UTXOSet.Reindex(); err != nil {
+		return err
+	}
+
+	count, err := UTXOSet.Count()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Done! There are %d unspent outputs in the UTXO set.\n", count)
+
+	return nil
+}
+
+func (cli *CommandLine) reindexTransactions() error {
+	chain, err := cli.continueBlockchain("")
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+	if err := chain.ReindexTransactions(); err != nil {
+		return err
+	}
+
+	fmt.Println("Done! Transaction index rebuilt.")
+
+	return nil
+}
+
+func (cli *CommandLine) migrateDatabase() error {
+	blocks, err := blockchain.MigrateDatabase(cli.dataDir, cli.network)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Done! %d blocks rewritten in the current database format.\n", blocks)
+
+	return nil
+}
+
+func (cli *CommandLine) getTransaction(id string) error {
+	txID, err := hex.DecodeString(id)
+	if err != nil {
+		return errors.New("Transaction ID not valid")
+	}
+	chain, err := cli.continueBlockchain("")
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+
+	tx, block, err := chain.FindTransactionBlock(txID)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Block: %x\n", block.Hash)
+	fmt.Printf("Previous Hash: %x\n", block.PrevHash)
+	fmt.Println(&tx)
+
+	return nil
 }
 
-func (cli *CommandLine) getBalance(address string) {
-	if !wallet.ValidateAddress(address) {
-		log.Panic("Address not valid")
+func (cli *CommandLine) getProof(id, out string) error {
+	txID, err := hex.DecodeString(id)
+	if err != nil {
+		return errors.New("Transaction ID not valid")
+	}
+	chain, err := cli.continueBlockchain("")
+	if err != nil {
+		return err
 	}
-	chain := blockchain.ContinueBlockchain(address)
 	defer chain.Database.Close()
 
-	balance := 0
-	pubKeyHash := wallet.Base58Decode([]byte(address))
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-wallet.ChecksumLength]
-	UTXOs := chain.FindUTXO(pubKeyHash)
-	for _, UTXO := range UTXOs {
-		balance += UTXO.Value
+	_, block, err := chain.FindTransactionBlock(txID)
+	if err != nil {
+		return err
+	}
+	proof, err := block.MerkleProof(txID)
+	if err != nil {
+		return err
+	}
+
+	file := proofFile{
+		TxID:       hex.EncodeToString(txID),
+		BlockHash:  hex.EncodeToString(block.Hash),
+		MerkleRoot: hex.EncodeToString(block.HashTransactions()),
+	}
+	for _, step := range proof.Path {
+		file.Path = append(file.Path, proofFileStep{hex.EncodeToString(step.Hash), step.Left})
+	}
+
+	content, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(out, content, 0644)
+	if err != nil {
+		return err
 	}
 
-	fmt.Printf("Balance of %s: %d\n", address, balance)
+	fmt.Printf("Proof for transaction %s written to %s\n", id, out)
+
+	return nil
 }
 
-func (cli *CommandLine) send(from, to string, amount int) {
-	if !wallet.ValidateAddress(from) {
-		log.Panic("Address not valid")
+func (cli *CommandLine) verifyProof(path string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var file proofFile
+	err = json.Unmarshal(content, &file)
+	if err != nil {
+		return err
+	}
+
+	txID, err := hex.DecodeString(file.TxID)
+	if err != nil {
+		return errors.New("Transaction ID not valid")
+	}
+	blockHash, err := hex.DecodeString(file.BlockHash)
+	if err != nil {
+		return errors.New("Block hash not valid")
+	}
+
+	proof := merkle.Proof{Data: txID}
+	for _, step := range file.Path {
+		hash, err := hex.DecodeString(step.Hash)
+		if err != nil {
+			return errors.New("Proof path not valid")
+		}
+		proof.Path = append(proof.Path, merkle.ProofStep{Hash: hash, Left: step.Left})
 	}
-	if !wallet.ValidateAddress(to) {
-		log.Panic("Address not valid")
+
+	chain, err := cli.continueBlockchain("")
+	if err != nil {
+		return err
 	}
-	chain := blockchain.ContinueBlockchain(from)
 	defer chain.Database.Close()
 
-	tx := blockchain.NewTransaction(from, to, amount, chain)
+	// The proof is checked against the Merkle root of the block stored in
+	// our chain, not against the root written in the proof file
+	block, err := chain.GetBlock(blockHash)
+	if err != nil {
+		return err
+	}
+
+	if !proof.Verify(block.HashTransactions()) {
+		return fmt.Errorf("%w for block %s", merkle.ErrInvalidProof, file.BlockHash)
+	}
+
+	fmt.Printf("Transaction %s is included in block %s\n", file.TxID, file.BlockHash)
 
-	chain.AddBlock([]*blockchain.Transaction{tx})
-	fmt.Println("Successful!")
+	return nil
 }
 
-func (cli *CommandLine) listAddresses() {
-	wallets, _ := wallet.CreateWallets()
+func (cli *CommandLine) verifyChain(level int) error {
+	chain, err := cli.continueBlockchain("")
+	if err != nil {
+		return err
+	}
+
+	count, err := chain.VerifyChain(level)
+	chain.Database.Close()
+
+	if err != nil {
+		return fmt.Errorf("Chain is corrupted after checking %d blocks: %w", count, err)
+	}
+
+	fmt.Printf("Chain verified: %d blocks checked at level %d\n", count, level)
+
+	return nil
+}
+
+func (cli *CommandLine) getBalance(address string) error {
+	pubKeyHash, err := wallet.AddressPubKeyHash(address, cli.params.AddressVersion)
+	if err != nil {
+		return err
+	}
+	chain, err := cli.continueBlockchain(address)
+	if err != nil {
+		return err
+	}
+	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
+	defer chain.Database.Close()
+
+	// Coinbase outputs cannot be spent until they mature
+	balance, immature, err := UTXOSet.Balance(pubKeyHash)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Balance of %s: %d (immature: %d)\n", address, balance, immature)
+
+	return nil
+}
+
+func (cli *CommandLine) send(sources []string, recipients []blockchain.Recipient, change, selectorName string, fee, feeRate int, mineNow bool) error {
+	for _, from := range sources {
+		if err := cli.validateAddress(from); err != nil {
+			return err
+		}
+	}
+	if change == "" {
+		change = sources[0]
+	} else if err := cli.validateAddress(change); err != nil {
+		return fmt.Errorf("change %w", err)
+	}
+	for _, r := range recipients {
+		if err := cli.validateAddress(r.Address); err != nil {
+			return err
+		}
+		if r.Amount <= 0 {
+			return fmt.Errorf("Amount sent to %s not valid", r.Address)
+		}
+	}
+	selector, err := blockchain.NewCoinSelector(selectorName)
+	if err != nil {
+		return err
+	}
+
+	chain, err := cli.continueBlockchain(sources[0])
+	if err != nil {
+		return err
+	}
+	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
+	defer chain.Database.Close()
+
+	build := func(fee int) (*blockchain.Transaction, error) {
+		return blockchain.NewMultiSourceTransaction(sources, recipients, change, fee, selector, &UTXOSet)
+	}
+
+	var tx *blockchain.Transaction
+	if feeRate > 0 {
+		tx, err = blockchain.FeeRateTransaction(feeRate, build)
+	} else {
+		tx, err = build(fee)
+	}
+	if err != nil {
+		return err
+	}
+
+	entry, err := blockchain.Mempool{Blockchain: chain}.Add(tx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Transaction %x added to the mempool with a fee of %d (%d bytes)\n", tx.ID, entry.Fee, entry.Size)
+
+	if mineNow {
+		// Stop mining cleanly on Ctrl-C, so that the database gets closed
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+
+		err := cli.mineBlock(ctx, chain, sources[0])
+		if err == context.Canceled {
+			fmt.Println("Interrupted! No block was added.")
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Mine a block with the pending transactions of the mempool, rewarding the
+// given address, and print the block along with the time taken
+func (cli *CommandLine) mineBlock(ctx context.Context, chain *blockchain.Blockchain, address string) error {
+	start := time.Now()
+
+	block, err := chain.MempoolTemplate(address)
+	if err != nil {
+		return err
+	}
+	if err := chain.MineBlock(ctx, block); err != nil {
+		return err
+	}
+
+	elapsed := time.Since(start).Round(time.Millisecond)
+	fmt.Printf("Mined block %d (%x) with %d transactions in %s\n", block.Height, block.Hash, len(block.Transactions), elapsed)
+
+	return nil
+}
+
+// Mine count blocks, or blocks until interrupted, rewarding the given address
+func (cli *CommandLine) mine(address string, count int, continuous bool) error {
+	if err := cli.validateAddress(address); err != nil {
+		return err
+	}
+	chain, err := cli.continueBlockchain(address)
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+
+	// Stop mining cleanly on Ctrl-C, so that the database gets closed
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	for i := 0; continuous || i < count; i++ {
+		err := cli.mineBlock(ctx, chain, address)
+		if err == context.Canceled {
+			fmt.Println("Interrupted! No block was added.")
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (cli *CommandLine) listMempool() error {
+	chain, err := cli.continueBlockchain("")
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+
+	entries, err := blockchain.Mempool{Blockchain: chain}.Entries()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%d pending transactions:\n", len(entries))
+	for _, entry := range entries {
+		added := time.Unix(entry.Added, 0).UTC()
+		fmt.Printf("  %x fee: %d size: %d rate: %.3f/kB added: %s\n", entry.Tx.ID, entry.Fee, entry.Size, entry.FeeRate(), added)
+	}
+
+	return nil
+}
+
+func (cli *CommandLine) dropFromMempool(id string) error {
+	txID, err := hex.DecodeString(id)
+	if err != nil {
+		return errors.New("Transaction ID not valid")
+	}
+
+	chain, err := cli.continueBlockchain("")
+	if err != nil {
+		return err
+	}
+	defer chain.Database.Close()
+
+	if err := (blockchain.Mempool{Blockchain: chain}).Remove(txID); err != nil {
+		return err
+	}
+	fmt.Printf("Transaction %x dropped from the mempool\n", txID)
+
+	return nil
+}
+
+func (cli *CommandLine) listAddresses() error {
+	wallets, err := cli.wallets()
+	if err != nil {
+		return err
+	}
 
 	addresses := wallets.GetAllAddresses()
 
 	for _, address := range addresses {
 		fmt.Println(address)
 	}
+
+	return nil
 }
 
-func (cli *CommandLine) createWallet() {
-	wallets, _ := wallet.CreateWallets()
+func (cli *CommandLine) createWallet() error {
+	wallets, err := cli.wallets()
+	if err != nil {
+		return err
+	}
 
-	address := wallets.AddWallet()
-	wallets.SaveFile()
+	address, err := wallets.AddWallet(cli.params.AddressVersion)
+	if err != nil {
+		return err
+	}
+	if err := wallets.SaveFile(); err != nil {
+		return err
+	}
 
 	fmt.Printf("New Address is: %s\n", address)
+
+	return nil
 }
 
-func (cli *CommandLine) Run() {
-	cli.validateArgs()
+// Run the command given by the arguments of the program and get its exit code
+func (cli *CommandLine) Run() int {
+	args, err := cli.parseGlobalFlags()
+	if err != nil {
+		return exitCode(err)
+	}
+	if !cli.validateArgs(args) {
+		return exitUsage
+	}
 
 	getBalanceCmd := flag.NewFlagSet("getbalance", flag.ExitOnError)
 	createBlockchainCmd := flag.NewFlagSet("createblockchain", flag.ExitOnError)
@@ -134,83 +912,343 @@ func (cli *CommandLine) Run() {
 	printChainCmd := flag.NewFlagSet("print", flag.ExitOnError)
 	createWalletCmd := flag.NewFlagSet("createwallet", flag.ExitOnError)
 	listAddressesCmd := flag.NewFlagSet("listaddresses", flag.ExitOnError)
+	reindexUTXOCmd := flag.NewFlagSet("reindexutxo", flag.ExitOnError)
+	reindexTxCmd := flag.NewFlagSet("reindextx", flag.ExitOnError)
+	migrateDBCmd := flag.NewFlagSet("migratedb", flag.ExitOnError)
+	getTxCmd := flag.NewFlagSet("gettx", flag.ExitOnError)
+	getBlockCmd := flag.NewFlagSet("getblock", flag.ExitOnError)
+	getBestHeightCmd := flag.NewFlagSet("getbestheight", flag.ExitOnError)
+	getSupplyCmd := flag.NewFlagSet("getsupply", flag.ExitOnError)
+	getProofCmd := flag.NewFlagSet("getproof", flag.ExitOnError)
+	verifyProofCmd := flag.NewFlagSet("verifyproof", flag.ExitOnError)
+	verifyChainCmd := flag.NewFlagSet("verifychain", flag.ExitOnError)
+	getPubKeyCmd := flag.NewFlagSet("getpubkey", flag.ExitOnError)
+	listSignersCmd := flag.NewFlagSet("listsigners", flag.ExitOnError)
+	proposeSignerCmd := flag.NewFlagSet("proposesigner", flag.ExitOnError)
+	mineCmd := flag.NewFlagSet("mine", flag.ExitOnError)
+	mempoolListCmd := flag.NewFlagSet("mempool list", flag.ExitOnError)
+	mempoolDropCmd := flag.NewFlagSet("mempool drop", flag.ExitOnError)
 
 	getBalanceAddress := getBalanceCmd.String("address", "", "Address whose balance is to be found")
 	createBlockchainAddress := createBlockchainCmd.String("address", "", "Address that mines the genesis block of the blockchain")
-	sendFromAddress := sendCmd.String("from", "", "Source Wallet address")
-	sendToAddress := sendCmd.String("to", "", "Destination Wallet address")
-	sendAmount := sendCmd.Int("amount", 0, "Amount to send")
+	var sendSources addressesFlag
+	sendCmd.Var(&sendSources, "from", "Source Wallet address; can be repeated or comma-separated to spend from several wallets")
+	sendChange := sendCmd.String("change", "", "Address receiving the change (default: the first source)")
+	sendSelector := sendCmd.String("selector", blockchain.DefaultCoinSelector, "Coin selection strategy: largest-first, smallest-first, bnb or random-improve")
+	var sendRecipients recipientsFlag
+	sendCmd.Var(&sendRecipients, "to", "Destination Wallet address, as ADDRESS (paid -amount) or ADDRESS:AMOUNT; can be repeated")
+	sendAmount := sendCmd.Int("amount", 0, "Amount to send to the destinations given without an amount")
+	sendOutputs := sendCmd.String("outputs", "", "JSON file listing the destinations as {\"address\": ADDRESS, \"amount\": AMOUNT} objects")
+	sendFee := sendCmd.Int("fee", 0, "Fee left to the miner of the block")
+	sendFeeRate := sendCmd.Int("feerate", 0, "Fee left to the miner per kilobyte (1000 bytes) of the transaction")
+	createBlockchainWorkers := createBlockchainCmd.Int("workers", 0, "Number of goroutines mining the genesis block (default: number of CPUs)")
+	createBlockchainProgress := createBlockchainCmd.Bool("progress", false, "Print the mining progress and hashrate")
+	createBlockchainConsensus := createBlockchainCmd.String("consensus", "pow", "Consensus engine of the blockchain: pow or poa")
+	createBlockchainSigners := createBlockchainCmd.String("signers", "", "Comma-separated hex public keys of the initial PoA signers")
+	createBlockchainGenesis := createBlockchainCmd.String("genesis", "", "JSON genesis file giving the chain parameters and initial balances (default: those of the network)")
+	sendWorkers := sendCmd.Int("workers", 0, "Number of goroutines mining the block (default: number of CPUs)")
+	sendProgress := sendCmd.Bool("progress", false, "Print the mining progress and hashrate")
+	sendMine := sendCmd.Bool("mine", false, "Mine a block with the pending transactions right away, rewarding the sender")
+	getTxID := getTxCmd.String("id", "", "ID of the transaction to print")
+	getBlockHeight := getBlockCmd.Int("height", -1, "Height of the block to print")
+	getBlockHash := getBlockCmd.String("hash", "", "Hash of the block to print")
+	getProofID := getProofCmd.String("id", "", "ID of the transaction to prove")
+	getProofOut := getProofCmd.String("out", "", "File to write the proof to")
+	verifyProofFile := verifyProofCmd.String("file", "", "File containing the proof to check")
+	verifyChainLevel := verifyChainCmd.Int("level", blockchain.VerifyUTXO, "Level of checks: 0 linkage and PoW, 1 Merkle roots, 2 signatures, 3 UTXO set")
+	getPubKeyAddress := getPubKeyCmd.String("address", "", "Address of the wallet whose public key is to be printed")
+	proposeSignerPubKey := proposeSignerCmd.String("pubkey", "", "Hex public key of the signer")
+	proposeSignerRemove := proposeSignerCmd.Bool("remove", false, "Vote to remove the signer instead of adding it")
+	proposeSignerDiscard := proposeSignerCmd.Bool("discard", false, "Discard the pending proposal about the signer")
+	mineAddress := mineCmd.String("address", "", "Address rewarded with the subsidy and fees of the block")
+	mineWorkers := mineCmd.Int("workers", 0, "Number of goroutines mining the block (default: number of CPUs)")
+	mineProgress := mineCmd.Bool("progress", false, "Print the mining progress and hashrate")
+	mineCount := mineCmd.Int("count", 1, "Number of blocks to mine")
+	mineContinuous := mineCmd.Bool("continuous", false, "Mine blocks until interrupted")
+	mempoolDropID := mempoolDropCmd.String("id", "", "ID of the transaction to drop")
 
-	switch os.Args[1] {
+	switch args[0] {
 
 	case "print":
-		err := printChainCmd.Parse(os.Args[2:])
+		err := printChainCmd.Parse(args[1:])
 		if err != nil {
-			log.Panic(err)
+			return exitCode(err)
 		}
 	case "getbalance":
-		err := getBalanceCmd.Parse(os.Args[2:])
+		err := getBalanceCmd.Parse(args[1:])
 		if err != nil {
-			log.Panic(err)
+			return exitCode(err)
 		}
 	case "send":
-		err := sendCmd.Parse(os.Args[2:])
+		err := sendCmd.Parse(args[1:])
 		if err != nil {
-			log.Panic(err)
+			return exitCode(err)
 		}
 	case "createblockchain":
-		err := createBlockchainCmd.Parse(os.Args[2:])
+		err := createBlockchainCmd.Parse(args[1:])
 		if err != nil {
-			log.Panic(err)
+			return exitCode(err)
 		}
 	case "createwallet":
-		err := createWalletCmd.Parse(os.Args[2:])
+		err := createWalletCmd.Parse(args[1:])
 		if err != nil {
-			log.Panic(err)
+			return exitCode(err)
 		}
 	case "listaddresses":
-		err := listAddressesCmd.Parse(os.Args[2:])
+		err := listAddressesCmd.Parse(args[1:])
+		if err != nil {
+			return exitCode(err)
+		}
+	case "reindexutxo":
+		err := reindexUTXOCmd.Parse(args[1:])
+		if err != nil {
+			return exitCode(err)
+		}
+	case "reindextx":
+		err := reindexTxCmd.Parse(args[1:])
+		if err != nil {
+			return exitCode(err)
+		}
+	case "migratedb":
+		err := migrateDBCmd.Parse(args[1:])
+		if err != nil {
+			return exitCode(err)
+		}
+	case "gettx":
+		err := getTxCmd.Parse(args[1:])
 		if err != nil {
-			log.Panic(err)
+			return exitCode(err)
+		}
+	case "getblock":
+		err := getBlockCmd.Parse(args[1:])
+		if err != nil {
+			return exitCode(err)
+		}
+	case "getbestheight":
+		err := getBestHeightCmd.Parse(args[1:])
+		if err != nil {
+			return exitCode(err)
+		}
+	case "getsupply":
+		err := getSupplyCmd.Parse(args[1:])
+		if err != nil {
+			return exitCode(err)
+		}
+	case "getproof":
+		err := getProofCmd.Parse(args[1:])
+		if err != nil {
+			return exitCode(err)
+		}
+	case "verifyproof":
+		err := verifyProofCmd.Parse(args[1:])
+		if err != nil {
+			return exitCode(err)
+		}
+	case "verifychain":
+		err := verifyChainCmd.Parse(args[1:])
+		if err != nil {
+			return exitCode(err)
+		}
+	case "getpubkey":
+		err := getPubKeyCmd.Parse(args[1:])
+		if err != nil {
+			return exitCode(err)
+		}
+	case "listsigners":
+		err := listSignersCmd.Parse(args[1:])
+		if err != nil {
+			return exitCode(err)
+		}
+	case "proposesigner":
+		err := proposeSignerCmd.Parse(args[1:])
+		if err != nil {
+			return exitCode(err)
+		}
+	case "mine":
+		err := mineCmd.Parse(args[1:])
+		if err != nil {
+			return exitCode(err)
+		}
+	case "mempool":
+		if len(args) < 2 {
+			cli.printUsage()
+			return exitUsage
+		}
+
+		switch args[1] {
+		case "list":
+			err := mempoolListCmd.Parse(args[2:])
+			if err != nil {
+				return exitCode(err)
+			}
+		case "drop":
+			err := mempoolDropCmd.Parse(args[2:])
+			if err != nil {
+				return exitCode(err)
+			}
+		default:
+			cli.printUsage()
+			return exitUsage
 		}
 	default:
 		cli.printUsage()
-		runtime.Goexit()
+		return exitUsage
 	}
 
 	if getBalanceCmd.Parsed() {
 		if *getBalanceAddress == "" {
 			getBalanceCmd.Usage()
-			runtime.Goexit()
+			return exitUsage
 		}
-		cli.getBalance(*getBalanceAddress)
+		return exitCode(cli.getBalance(*getBalanceAddress))
 	}
 
 	if printChainCmd.Parsed() {
-		cli.printChain()
+		return exitCode(cli.printChain())
 	}
 
 	if createBlockchainCmd.Parsed() {
-		if *createBlockchainAddress == "" {
+		if *createBlockchainAddress == "" || (*createBlockchainConsensus == "poa") == (*createBlockchainSigners == "") {
 			createBlockchainCmd.Usage()
-			runtime.Goexit()
+			return exitUsage
 		}
-		cli.createBlockchain(*createBlockchainAddress)
+		cli.configureMining(*createBlockchainWorkers, *createBlockchainProgress)
+		return exitCode(cli.createBlockchain(*createBlockchainAddress, *createBlockchainConsensus, *createBlockchainSigners, *createBlockchainGenesis))
 	}
 
 	if sendCmd.Parsed() {
-		if *sendFromAddress == "" || *sendToAddress == "" || *sendAmount <= 0 {
+		recipients := []blockchain.Recipient(sendRecipients)
+		if *sendOutputs != "" {
+			outputs, err := cli.readOutputsFile(*sendOutputs)
+			if err != nil {
+				return exitCode(err)
+			}
+			recipients = append(recipients, outputs...)
+		}
+
+		// Destinations given without an amount are paid the -amount flag
+		for i := range recipients {
+			if recipients[i].Amount == 0 {
+				recipients[i].Amount = *sendAmount
+			}
+		}
+
+		if len(sendSources) == 0 || len(recipients) == 0 || *sendFee < 0 || *sendFeeRate < 0 || (*sendFee > 0 && *sendFeeRate > 0) {
 			sendCmd.Usage()
-			runtime.Goexit()
+			return exitUsage
 		}
-		cli.send(*sendFromAddress, *sendToAddress, *sendAmount)
+		cli.configureMining(*sendWorkers, *sendProgress)
+		return exitCode(cli.send(sendSources, recipients, *sendChange, *sendSelector, *sendFee, *sendFeeRate, *sendMine))
 	}
 
 	if createWalletCmd.Parsed() {
-		cli.createWallet()
+		return exitCode(cli.createWallet())
 	}
 
 	if listAddressesCmd.Parsed() {
-		cli.listAddresses()
+		return exitCode(cli.listAddresses())
+	}
+
+	if reindexUTXOCmd.Parsed() {
+		return exitCode(cli.reindexUTXO())
+	}
+
+	if reindexTxCmd.Parsed() {
+		return exitCode(cli.reindexTransactions())
+	}
+
+	if migrateDBCmd.Parsed() {
+		return exitCode(cli.migrateDatabase())
+	}
+
+	if getTxCmd.Parsed() {
+		if *getTxID == "" {
+			getTxCmd.Usage()
+			return exitUsage
+		}
+		return exitCode(cli.getTransaction(*getTxID))
+	}
+
+	if getBlockCmd.Parsed() {
+		if (*getBlockHeight < 0) == (*getBlockHash == "") {
+			getBlockCmd.Usage()
+			return exitUsage
+		}
+		return exitCode(cli.getBlock(*getBlockHeight, *getBlockHash))
+	}
+
+	if getBestHeightCmd.Parsed() {
+		return exitCode(cli.getBestHeight())
+	}
+
+	if getSupplyCmd.Parsed() {
+		return exitCode(cli.getSupply())
+	}
+
+	if getProofCmd.Parsed() {
+		if *getProofID == "" || *getProofOut == "" {
+			getProofCmd.Usage()
+			return exitUsage
+		}
+		return exitCode(cli.getProof(*getProofID, *getProofOut))
 	}
+
+	if verifyProofCmd.Parsed() {
+		if *verifyProofFile == "" {
+			verifyProofCmd.Usage()
+			return exitUsage
+		}
+		return exitCode(cli.verifyProof(*verifyProofFile))
+	}
+
+	if verifyChainCmd.Parsed() {
+		if *verifyChainLevel < blockchain.VerifyLinkage || *verifyChainLevel > blockchain.VerifyUTXO {
+			verifyChainCmd.Usage()
+			return exitUsage
+		}
+		return exitCode(cli.verifyChain(*verifyChainLevel))
+	}
+
+	if getPubKeyCmd.Parsed() {
+		if *getPubKeyAddress == "" {
+			getPubKeyCmd.Usage()
+			return exitUsage
+		}
+		return exitCode(cli.getPubKey(*getPubKeyAddress))
+	}
+
+	if listSignersCmd.Parsed() {
+		return exitCode(cli.listSigners())
+	}
+
+	if proposeSignerCmd.Parsed() {
+		if *proposeSignerPubKey == "" {
+			proposeSignerCmd.Usage()
+			return exitUsage
+		}
+		return exitCode(cli.proposeSigner(*proposeSignerPubKey, *proposeSignerRemove, *proposeSignerDiscard))
+	}
+
+	if mineCmd.Parsed() {
+		if *mineAddress == "" || *mineCount < 1 {
+			mineCmd.Usage()
+			return exitUsage
+		}
+		cli.configureMining(*mineWorkers, *mineProgress)
+		return exitCode(cli.mine(*mineAddress, *mineCount, *mineContinuous))
+	}
+
+	if mempoolListCmd.Parsed() {
+		return exitCode(cli.listMempool())
+	}
+
+	if mempoolDropCmd.Parsed() {
+		if *mempoolDropID == "" {
+			mempoolDropCmd.Usage()
+			return exitUsage
+		}
+		return exitCode(cli.dropFromMempool(*mempoolDropID))
+	}
+
+	return exitOK
 }
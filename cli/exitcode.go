@@ -0,0 +1,78 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/tezansahu/golang_blockchain/blockchain"
+	"github.com/tezansahu/golang_blockchain/merkle"
+	"github.com/tezansahu/golang_blockchain/wallet"
+)
+
+// Exit codes of the commands, telling scripts why a command failed
+const (
+	exitOK                = 0
+	exitFailure           = 1 // Any error not listed below
+	exitUsage             = 2 // Missing or invalid arguments, as for flag parsing errors
+	exitChainNotFound     = 3
+	exitChainExists       = 4
+	exitOutdatedDatabase  = 5
+	exitParamsMismatch    = 6
+	exitInvalidAddress    = 7
+	exitUnknownWallet     = 8
+	exitInsufficientFunds = 9
+	exitNotFound          = 10 // Block or transaction not found
+	exitRejected          = 11 // Transaction or block rejected by validation
+	exitCorrupted         = 12 // Chain found corrupted by verifychain
+	exitInvalidProof      = 13 // Inclusion proof rejected by verifyproof
+)
+
+// Exit codes of the errors commands fail with, along with a hint printed to
+// the user. The first error matched by the failure decides the exit code.
+var exitCodes = []struct {
+	err  error
+	code int
+	hint string
+}{
+	{blockchain.ErrChainNotFound, exitChainNotFound, "Create one with createblockchain!"},
+	{blockchain.ErrChainExists, exitChainExists, ""},
+	{blockchain.ErrOutdatedDatabase, exitOutdatedDatabase, "Migrate it with migratedb!"},
+	{blockchain.ErrParamsMismatch, exitParamsMismatch, ""},
+	{wallet.ErrInvalidAddress, exitInvalidAddress, ""},
+	{wallet.ErrUnknownWallet, exitUnknownWallet, "Create a wallet with createwallet, or check the -network flag."},
+	{blockchain.ErrInsufficientFunds, exitInsufficientFunds, ""},
+	{blockchain.ErrBlockNotFound, exitNotFound, ""},
+	{blockchain.ErrTxNotFound, exitNotFound, ""},
+	{merkle.ErrInvalidProof, exitInvalidProof, ""},
+}
+
+// Report the error a command failed with, if any, and get the exit code of the command
+func exitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+
+	fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+
+	for _, e := range exitCodes {
+		if errors.Is(err, e.err) {
+			if e.hint != "" {
+				fmt.Fprintln(os.Stderr, e.hint)
+			}
+			return e.code
+		}
+	}
+
+	var validationErr *blockchain.ValidationError
+	if errors.As(err, &validationErr) {
+		return exitRejected
+	}
+
+	var corruptionErr *blockchain.CorruptionError
+	if errors.As(err, &corruptionErr) {
+		return exitCorrupted
+	}
+
+	return exitFailure
+}
@@ -0,0 +1,166 @@
+package merkle
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+)
+
+// Error returned when an inclusion proof does not lead to the expected root
+var ErrInvalidProof = errors.New("inclusion proof is not valid")
+
+// Prefixes used to separate the hashes of leaves from the hashes of inner nodes,
+// so that an inner node can never be passed off as a leaf (and vice versa)
+var (
+	leafPrefix = []byte{0x00}
+	nodePrefix = []byte{0x01}
+)
+
+// Structure of a node of a Merkle Tree
+type Node struct {
+	Left  *Node
+	Right *Node
+	Hash  []byte
+}
+
+// Structure of a Merkle Tree, built bottom-up from its leaves
+type Tree struct {
+	Root   *Node
+	Levels [][]*Node // Nodes of every level of the tree, starting with the leaves
+}
+
+// Structure of a step of an inclusion proof: the hash of the sibling
+// of the current node and whether that sibling lies on the left
+type ProofStep struct {
+	Hash []byte
+	Left bool
+}
+
+// Inclusion proof of a piece of data: the path of siblings from its leaf up to the root
+type Proof struct {
+	Data []byte
+	Path []ProofStep
+}
+
+// Hash the data of a leaf
+func hashLeaf(data []byte) []byte {
+	hash := sha256.Sum256(append(append([]byte{}, leafPrefix...), data...))
+
+	return hash[:]
+}
+
+// Hash the concatenation of the hashes of two child nodes
+func hashChildren(left, right []byte) []byte {
+	hash := sha256.Sum256(bytes.Join([][]byte{nodePrefix, left, right}, []byte{}))
+
+	return hash[:]
+}
+
+// Create a new Merkle Tree node from its children, or a leaf node if it has no children
+func NewNode(left, right *Node, data []byte) *Node {
+	node := Node{left, right, nil}
+
+	if left == nil && right == nil {
+		node.Hash = hashLeaf(data)
+	} else {
+		node.Hash = hashChildren(left.Hash, right.Hash)
+	}
+
+	return &node
+}
+
+// Create a Merkle Tree from the given pieces of data. If a level has an odd
+// number of nodes, the last node is paired with itself, so repeating the last
+// pieces of data gives the same root: users of the tree must reject repeated
+// pieces of data.
+func NewTree(data [][]byte) *Tree {
+	var leaves []*Node
+
+	for _, d := range data {
+		leaves = append(leaves, NewNode(nil, nil, d))
+	}
+
+	if len(leaves) == 0 {
+		root := NewNode(nil, nil, []byte{})
+		return &Tree{root, [][]*Node{{root}}}
+	}
+
+	levels := [][]*Node{leaves}
+	level := leaves
+	for len(level) > 1 {
+		var next []*Node
+
+		for i := 0; i < len(level); i += 2 {
+			right := level[i]
+			if i+1 < len(level) {
+				right = level[i+1]
+			}
+			next = append(next, NewNode(level[i], right, nil))
+		}
+
+		levels = append(levels, next)
+		level = next
+	}
+
+	return &Tree{level[0], levels}
+}
+
+// Get the hash of the root of the tree
+func (t *Tree) RootHash() []byte {
+	return t.Root.Hash
+}
+
+// Build the inclusion proof of the leaf at the given index
+func (t *Tree) proofAt(index int) []ProofStep {
+	var path []ProofStep
+
+	// Collect the sibling of the current node on every level below the root
+	for _, level := range t.Levels[:len(t.Levels)-1] {
+		if index%2 == 0 {
+			sibling := index + 1
+			if sibling == len(level) {
+				sibling = index
+			}
+			path = append(path, ProofStep{level[sibling].Hash, false})
+		} else {
+			path = append(path, ProofStep{level[index-1].Hash, true})
+		}
+
+		index /= 2
+	}
+
+	return path
+}
+
+// Produce the inclusion proof of a piece of data in the tree
+func (t *Tree) Proof(data []byte) (*Proof, error) {
+	leafHash := hashLeaf(data)
+
+	for i, leaf := range t.Levels[0] {
+		if bytes.Compare(leaf.Hash, leafHash) == 0 {
+			return &Proof{data, t.proofAt(i)}, nil
+		}
+	}
+
+	return nil, errors.New("Data is not part of the Merkle Tree")
+}
+
+// Compute the root hash implied by an inclusion proof
+func (p *Proof) RootHash() []byte {
+	hash := hashLeaf(p.Data)
+
+	for _, step := range p.Path {
+		if step.Left {
+			hash = hashChildren(step.Hash, hash)
+		} else {
+			hash = hashChildren(hash, step.Hash)
+		}
+	}
+
+	return hash
+}
+
+// Check that an inclusion proof leads to the given root hash
+func (p *Proof) Verify(root []byte) bool {
+	return bytes.Compare(p.RootHash(), root) == 0
+}
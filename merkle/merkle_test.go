@@ -0,0 +1,137 @@
+package merkle
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// Build the given number of distinct pieces of data
+func testData(n int) [][]byte {
+	var data [][]byte
+	for i := 0; i < n; i++ {
+		data = append(data, []byte(fmt.Sprintf("tx%d", i)))
+	}
+
+	return data
+}
+
+// Compute the root of a tree the way it is defined, pairing the last node of
+// odd levels with itself
+func expectedRoot(data [][]byte) []byte {
+	var level [][]byte
+	for _, d := range data {
+		level = append(level, hashLeaf(d))
+	}
+
+	for len(level) > 1 {
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			right := level[i]
+			if i+1 < len(level) {
+				right = level[i+1]
+			}
+			next = append(next, hashChildren(level[i], right))
+		}
+		level = next
+	}
+
+	return level[0]
+}
+
+func TestRootHash(t *testing.T) {
+	for _, n := range []int{1, 2, 3, 4, 5, 6, 7, 8, 9} {
+		data := testData(n)
+		if root := NewTree(data).RootHash(); !bytes.Equal(root, expectedRoot(data)) {
+			t.Errorf("%d leaves: root is %x, want %x", n, root, expectedRoot(data))
+		}
+	}
+
+	// Repeating the last leaf of an odd level keeps the root
+	data := testData(3)
+	if !bytes.Equal(NewTree(data).RootHash(), NewTree(append(data, data[2])).RootHash()) {
+		t.Error("repeating the last of 3 leaves changes the root")
+	}
+
+	// Every other change to the leaves changes the root
+	if bytes.Equal(NewTree(testData(3)).RootHash(), NewTree(testData(4)).RootHash()) {
+		t.Error("adding a distinct leaf keeps the root")
+	}
+	swapped := [][]byte{data[1], data[0], data[2]}
+	if bytes.Equal(NewTree(data).RootHash(), NewTree(swapped).RootHash()) {
+		t.Error("swapping two leaves keeps the root")
+	}
+}
+
+func TestProof(t *testing.T) {
+	for _, n := range []int{1, 2, 3, 5, 7, 8} {
+		data := testData(n)
+		tree := NewTree(data)
+
+		for _, i := range []int{0, n / 2, n - 1} {
+			proof, err := tree.Proof(data[i])
+			if err != nil {
+				t.Fatalf("%d leaves: proof of leaf %d: %v", n, i, err)
+			}
+			if !proof.Verify(tree.RootHash()) {
+				t.Errorf("%d leaves: proof of leaf %d does not verify", n, i)
+			}
+			if proof.Verify(NewTree(testData(n + 1)).RootHash()) {
+				t.Errorf("%d leaves: proof of leaf %d verifies against another root", n, i)
+			}
+		}
+	}
+
+	if _, err := NewTree(testData(3)).Proof([]byte("missing")); err == nil {
+		t.Error("proof of data not in the tree did not fail")
+	}
+}
+
+func TestTamperedProof(t *testing.T) {
+	data := testData(7)
+	tree := NewTree(data)
+
+	for _, i := range []int{0, 3, 6} {
+		for step := range tree.proofAt(i) {
+			proof, err := tree.Proof(data[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			proof.Path[step].Hash = append([]byte{}, proof.Path[step].Hash...)
+			proof.Path[step].Hash[0] ^= 1
+			if proof.Verify(tree.RootHash()) {
+				t.Errorf("leaf %d: proof with a tampered hash at step %d verifies", i, step)
+			}
+
+			proof, _ = tree.Proof(data[i])
+			proof.Path[step].Left = !proof.Path[step].Left
+			// Flipping the side of a sibling equal to the current node changes nothing
+			if bytes.Equal(proof.Path[step].Hash, pathHash(proof, step)) {
+				continue
+			}
+			if proof.Verify(tree.RootHash()) {
+				t.Errorf("leaf %d: proof with a flipped side at step %d verifies", i, step)
+			}
+		}
+
+		proof, _ := tree.Proof(data[i])
+		proof.Data = []byte("forged")
+		if proof.Verify(tree.RootHash()) {
+			t.Errorf("leaf %d: proof of other data verifies", i)
+		}
+	}
+}
+
+// Compute the hash of the current node of a proof before the given step
+func pathHash(p *Proof, step int) []byte {
+	hash := hashLeaf(p.Data)
+	for _, s := range p.Path[:step] {
+		if s.Left {
+			hash = hashChildren(s.Hash, hash)
+		} else {
+			hash = hashChildren(hash, s.Hash)
+		}
+	}
+
+	return hash
+}
@@ -1,7 +1,7 @@
 package wallet
 
 import (
-	"log"
+	"fmt"
 
 	"github.com/mr-tron/base58"
 )
@@ -14,11 +14,11 @@ func Base58Encode(input []byte) []byte {
 }
 
 // Wrapper for base58 decoding
-func Base58Decode(input []byte) []byte {
+func Base58Decode(input []byte) ([]byte, error) {
 	decode, err := base58.Decode(string(input[:]))
 	if err != nil {
-		log.Panic(err)
+		return nil, fmt.Errorf("%w: %v", ErrInvalidAddress, err)
 	}
 
-	return decode
+	return decode, nil
 }
@@ -6,63 +6,89 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
-	"log"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"math/big"
 
 	"golang.org/x/crypto/ripemd160"
 )
 
 const (
-	ChecksumLength = 4          // Length of checksum
-	version        = byte(0x00) // Version of the protocol
+	ChecksumLength = 4 // Length of checksum
 )
 
 // Structure for a Wallet
 type Wallet struct {
 	PrivateKey ecdsa.PrivateKey
 	PublicKey  []byte
+	Version    byte // Version byte of the addresses of the network the wallet belongs to
 }
 
-// Validate the address of a user
-func ValidateAddress(address string) bool {
-	pubKeyHash := Base58Decode([]byte(address))
+// Error returned for addresses that are not valid on the network
+var ErrInvalidAddress = errors.New("invalid address")
+
+// Validate the address of a user on the network using the given address version byte
+func ValidateAddress(address string, version byte) error {
+	_, err := AddressPubKeyHash(address, version)
+
+	return err
+}
+
+// Get the public key hash an address of the network using the given address
+// version byte pays to, after checking its version byte and checksum
+func AddressPubKeyHash(address string, version byte) ([]byte, error) {
+	pubKeyHash, err := Base58Decode([]byte(address))
+	if err != nil {
+		return nil, err
+	}
+	if len(pubKeyHash) <= 1+ChecksumLength || pubKeyHash[0] != version {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidAddress, address)
+	}
 	actualChecksum := pubKeyHash[len(pubKeyHash)-ChecksumLength:]
-	version := pubKeyHash[0]
 	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-ChecksumLength]
 	targetChecksum := Checksum(append([]byte{version}, pubKeyHash...))
 
-	return bytes.Compare(actualChecksum, targetChecksum) == 0
+	if !bytes.Equal(actualChecksum, targetChecksum) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidAddress, address)
+	}
+
+	return pubKeyHash, nil
 }
 
 // Generate a new Key Pair using ECDSA curve
-func NewKeyPair() (ecdsa.PrivateKey, []byte) {
+func NewKeyPair() (ecdsa.PrivateKey, []byte, error) {
 	curve := elliptic.P256()
 	private, err := ecdsa.GenerateKey(curve, rand.Reader)
 
 	if err != nil {
-		log.Panic(err)
+		return ecdsa.PrivateKey{}, nil, err
 	}
 
-	pub := append(private.PublicKey.X.Bytes(), private.PublicKey.Y.Bytes()...)
-	return *private, pub
+	// Pad X and Y to the size of the curve, so that the public key splits evenly
+	pub := make([]byte, 64)
+	private.PublicKey.X.FillBytes(pub[:32])
+	private.PublicKey.Y.FillBytes(pub[32:])
+	return *private, pub, nil
 }
 
-// Make a new wallet
-func MakeWallet() *Wallet {
-	private, public := NewKeyPair()
-	wallet := Wallet{private, public}
-	return &wallet
+// Make a new wallet for the network using the given address version byte
+func MakeWallet(version byte) (*Wallet, error) {
+	private, public, err := NewKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	wallet := Wallet{private, public, version}
+	return &wallet, nil
 }
 
 // Obtain the hash of a Public Key
 func PublicKeyHash(pubkey []byte) []byte {
 	pubHash := sha256.Sum256(pubkey) // First, obtain the SHA256 hash of the public key
 
-	// Now, use RipeMD160 to hash the above hash
+	// Now, use RipeMD160 to hash the above hash (writing to a hash never fails)
 	hasher := ripemd160.New()
-	_, err := hasher.Write(pubHash[:])
-	if err != nil {
-		log.Panic(err)
-	}
+	hasher.Write(pubHash[:])
 
 	publicRipMD := hasher.Sum(nil)
 
@@ -87,7 +113,7 @@ func (w Wallet) Address() []byte {
 	pubHash := PublicKeyHash(w.PublicKey)
 
 	// Append the version of protocol to the hash and obtain a checksum
-	versionedHash := append([]byte{version}, pubHash...)
+	versionedHash := append([]byte{w.Version}, pubHash...)
 	checksum := Checksum(versionedHash)
 
 	// Use the checksum to get the full hash
@@ -102,3 +128,35 @@ func (w Wallet) Address() []byte {
 
 	return address
 }
+
+// Structure in which a wallet is stored in the wallets file. Only the private
+// scalar is kept, since the curve is always P-256 and the rest of the key
+// derives from it (gob cannot encode the curve itself).
+type gobWallet struct {
+	D         []byte
+	PublicKey []byte
+	Version   byte
+}
+
+func (w Wallet) GobEncode() ([]byte, error) {
+	var content bytes.Buffer
+	err := gob.NewEncoder(&content).Encode(gobWallet{w.PrivateKey.D.Bytes(), w.PublicKey, w.Version})
+
+	return content.Bytes(), err
+}
+
+func (w *Wallet) GobDecode(data []byte) error {
+	var gw gobWallet
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&gw); err != nil {
+		return err
+	}
+
+	curve := elliptic.P256()
+	w.PrivateKey.Curve = curve
+	w.PrivateKey.D = new(big.Int).SetBytes(gw.D)
+	w.PrivateKey.X, w.PrivateKey.Y = curve.ScalarBaseMult(gw.D)
+	w.PublicKey = gw.PublicKey
+	w.Version = gw.Version
+
+	return nil
+}
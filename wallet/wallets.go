@@ -2,58 +2,68 @@ package wallet
 
 import (
 	"bytes"
+	"crypto/ecdsa"
 	"crypto/elliptic"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"math/big"
 	"os"
+	"path/filepath"
 )
 
-// File where data about wallets will be stored
-const walletFile = "./tmp/wallets.data"
+// Name of the file where data about wallets will be stored, in the data directory of a network
+const walletFile = "wallets.data"
 
 // Structure of Wallets
 type Wallets struct {
 	Wallets map[string]*Wallet
+	file    string // Path of the file the wallets are saved to
 }
 
+// Error returned when no wallet of the wallets file holds the key of an address
+var ErrUnknownWallet = errors.New("no wallet for the address")
+
 // Save the wallets to the file
-func (ws *Wallets) SaveFile() {
+func (ws *Wallets) SaveFile() error {
 	var content bytes.Buffer
 
-	gob.Register(elliptic.P256())
-
 	encoder := gob.NewEncoder(&content)
 	err := encoder.Encode(ws)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 
-	err = ioutil.WriteFile(walletFile, content.Bytes(), 0644)
+	err = os.MkdirAll(filepath.Dir(ws.file), 0755)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
+
+	return ioutil.WriteFile(ws.file, content.Bytes(), 0644)
 }
 
 // Load wallets from the file
 func (ws *Wallets) LoadFile() error {
-	if _, err := os.Stat(walletFile); err != nil {
+	if _, err := os.Stat(ws.file); err != nil {
 		return err
 	}
 
 	var wallets Wallets
-	fileContent, err := ioutil.ReadFile(walletFile)
+	fileContent, err := ioutil.ReadFile(ws.file)
 	if err != nil {
 		return err
 	}
 
-	gob.Register(elliptic.P256())
-
 	decoder := gob.NewDecoder(bytes.NewReader(fileContent))
 	err = decoder.Decode(&wallets)
 	if err != nil {
-		return err
+		// Fall back to the format of older versions
+		legacy, legacyErr := decodeLegacyWallets(fileContent)
+		if legacyErr != nil {
+			return err
+		}
+		wallets.Wallets = legacy
 	}
 
 	ws.Wallets = wallets.Wallets
@@ -61,10 +71,84 @@ func (ws *Wallets) LoadFile() error {
 	return nil
 }
 
-// Create wallets using existing data from the file
-func CreateWallets() (*Wallets, error) {
+// Structures in which older versions stored the wallets: the whole ECDSA key
+// was gob encoded, of which only the coordinates and the scalar are read back
+// (the curve, always P-256, cannot be decoded). Those wallets all belong to
+// mainnet, whose address version byte is 0x00.
+type legacyPublicKey struct {
+	X, Y *big.Int
+}
+
+type legacyPrivateKey struct {
+	PublicKey legacyPublicKey
+	D         *big.Int
+}
+
+type legacyWallet struct {
+	PrivateKey legacyPrivateKey
+	PublicKey  []byte
+}
+
+type legacyWalletsFile struct {
+	Wallets map[string]*legacyWallet
+}
+
+// Decode a wallets file written by older versions
+func decodeLegacyWallets(data []byte) (map[string]*Wallet, error) {
+	var file legacyWalletsFile
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&file); err != nil {
+		return nil, err
+	}
+
+	wallets := make(map[string]*Wallet)
+	for address, lw := range file.Wallets {
+		if lw.PrivateKey.D == nil {
+			return nil, fmt.Errorf("wallet of %s has no private key", address)
+		}
+
+		var private ecdsa.PrivateKey
+		private.Curve = elliptic.P256()
+		private.D = lw.PrivateKey.D
+		private.X, private.Y = private.Curve.ScalarBaseMult(lw.PrivateKey.D.Bytes())
+
+		// The public key is kept as it was, since the address derives from it
+		wallets[address] = &Wallet{private, lw.PublicKey, 0x00}
+	}
+
+	return wallets, nil
+}
+
+// Move the wallets file kept directly in the data directory by older versions
+// into the given directory, adding its wallets to those already there
+func MoveLegacyWallets(dataDir, dir string) error {
+	legacy, err := CreateWallets(dataDir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	wallets, err := CreateWallets(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for address, w := range legacy.Wallets {
+		if _, ok := wallets.Wallets[address]; !ok {
+			wallets.Wallets[address] = w
+		}
+	}
+	if err := wallets.SaveFile(); err != nil {
+		return err
+	}
+
+	return os.Remove(legacy.file)
+}
+
+// Create wallets using existing data from the file in the given directory
+func CreateWallets(dir string) (*Wallets, error) {
 	wallets := Wallets{}
 	wallets.Wallets = make(map[string]*Wallet)
+	wallets.file = filepath.Join(dir, walletFile)
 
 	err := wallets.LoadFile()
 
@@ -72,8 +156,13 @@ func CreateWallets() (*Wallets, error) {
 }
 
 // Get the wallet belonging to an address
-func (ws *Wallets) GetWallet(address string) Wallet {
-	return *ws.Wallets[address]
+func (ws *Wallets) GetWallet(address string) (Wallet, error) {
+	wallet, ok := ws.Wallets[address]
+	if !ok {
+		return Wallet{}, fmt.Errorf("%w: %s", ErrUnknownWallet, address)
+	}
+
+	return *wallet, nil
 }
 
 // Get data of all addresses (of all wallets) saved
@@ -86,11 +175,14 @@ func (ws *Wallets) GetAllAddresses() []string {
 	return addresses
 }
 
-// Add a new wallet to the wallets
-func (ws *Wallets) AddWallet() string {
-	wallet := MakeWallet()
+// Add a new wallet to the wallets, for the network using the given address version byte
+func (ws *Wallets) AddWallet(version byte) (string, error) {
+	wallet, err := MakeWallet(version)
+	if err != nil {
+		return "", err
+	}
 	address := fmt.Sprintf("%s", wallet.Address())
 
 	ws.Wallets[address] = wallet
-	return address
+	return address, nil
 }